@@ -144,6 +144,53 @@ func TestFullWorkflow(t *testing.T) {
 			}
 		})
 
+		t.Run("Check expression AST", func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://localhost:8080/api/v1/expressions/"+calcResp.ID+"/ast", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Get expression AST failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+			}
+
+			type node struct {
+				Operator string   `json:"operator"`
+				TaskID   string   `json:"task_id"`
+				Status   string   `json:"status"`
+				Result   *float64 `json:"result"`
+				Right    *struct {
+					Operator string `json:"operator"`
+					TaskID   string `json:"task_id"`
+					Status   string `json:"status"`
+				} `json:"right"`
+			}
+			var astResp struct {
+				AST node `json:"ast"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&astResp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			root := astResp.AST
+			if root.Operator != "+" || root.TaskID == "" || root.Status != "completed" {
+				t.Errorf("Unexpected AST root: %+v", root)
+			}
+			if root.Result == nil || *root.Result != 6 {
+				t.Errorf("Expected root result 6, got %v", root.Result)
+			}
+			if root.Right == nil || root.Right.Operator != "*" || root.Right.TaskID == "" || root.Right.Status != "completed" {
+				t.Errorf("Unexpected AST right child: %+v", root.Right)
+			}
+		})
+
 		t.Run("Check expressions history", func(t *testing.T) {
 			req, err := http.NewRequest("GET", "http://localhost:8080/api/v1/expressions", nil)
 			if err != nil {
@@ -193,6 +240,121 @@ func TestFullWorkflow(t *testing.T) {
 		})
 	})
 
+	t.Run("Optimized expression", func(t *testing.T) {
+		reqBody := []byte(`{"expression":"2+2*2","optimize":true}`)
+		req, err := http.NewRequest("POST", "http://localhost:8080/api/v1/calculate", bytes.NewReader(reqBody))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Calculate request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var calcResp struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&calcResp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		req, err = http.NewRequest("GET", "http://localhost:8080/api/v1/expressions/"+calcResp.ID, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("Get expression failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var exprResp struct {
+			Expression struct {
+				Status     string  `json:"status"`
+				Result     float64 `json:"result"`
+				TasksSaved int     `json:"tasks_saved"`
+			} `json:"expression"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&exprResp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		if exprResp.Expression.Status != "completed" || exprResp.Expression.Result != 6 {
+			t.Errorf("Expected folded expression to complete with 6, got %+v", exprResp.Expression)
+		}
+		if exprResp.Expression.TasksSaved != 2 {
+			t.Errorf("Expected 2 tasks saved, got %d", exprResp.Expression.TasksSaved)
+		}
+	})
+
+	t.Run("Expression timeout", func(t *testing.T) {
+		reqBody := []byte(`{"expression":"2+2*2","timeout_ms":1}`)
+		req, err := http.NewRequest("POST", "http://localhost:8080/api/v1/calculate", bytes.NewReader(reqBody))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Calculate request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var calcResp struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&calcResp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		var status, reason string
+		for i := 0; i < 10; i++ {
+			time.Sleep(300 * time.Millisecond)
+
+			req, err := http.NewRequest("GET", "http://localhost:8080/api/v1/expressions/"+calcResp.ID, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Get expression failed: %v", err)
+			}
+
+			var exprResp struct {
+				Expression struct {
+					Status string `json:"status"`
+					Reason string `json:"error_reason"`
+				} `json:"expression"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&exprResp)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			status, reason = exprResp.Expression.Status, exprResp.Expression.Reason
+			if status != "pending" {
+				break
+			}
+		}
+
+		if status != "timed_out" || reason != "timeout" {
+			t.Errorf("Expected expression to time out, got status %q, reason %q", status, reason)
+		}
+	})
+
 	t.Run("Error handling", func(t *testing.T) {
 		t.Run("Invalid token", func(t *testing.T) {
 			reqBody := []byte(`{"expression":"2+2"}`)
@@ -216,7 +378,7 @@ func TestFullWorkflow(t *testing.T) {
 		})
 
 		t.Run("Invalid expression", func(t *testing.T) {
-			reqBody := []byte(`{"expression":"2++2"}`)
+			reqBody := []byte(`{"expression":"2+*2"}`)
 			req, err := http.NewRequest("POST", "http://localhost:8080/api/v1/calculate", bytes.NewReader(reqBody))
 			if err != nil {
 				t.Fatalf("Failed to create request: %v", err)
@@ -234,6 +396,50 @@ func TestFullWorkflow(t *testing.T) {
 			if resp.StatusCode != http.StatusUnprocessableEntity {
 				t.Errorf("Expected status 422 for invalid expression, got %d", resp.StatusCode)
 			}
+
+			var errResp struct {
+				ParseError struct {
+					Offset int    `json:"offset"`
+					Token  string `json:"token"`
+				} `json:"parse_error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if errResp.ParseError.Offset != 2 || errResp.ParseError.Token != "*" {
+				t.Errorf("Expected parse error at offset 2 on \"*\", got %+v", errResp.ParseError)
+			}
+		})
+
+		t.Run("Unbound variables", func(t *testing.T) {
+			reqBody := []byte(`{"expression":"a*x+b","variables":{"x":3}}`)
+			req, err := http.NewRequest("POST", "http://localhost:8080/api/v1/calculate", bytes.NewReader(reqBody))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Errorf("Expected status 422 for unbound variables, got %d", resp.StatusCode)
+			}
+
+			var errResp struct {
+				Missing []string `json:"missing"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(errResp.Missing) != 2 || errResp.Missing[0] != "a" || errResp.Missing[1] != "b" {
+				t.Errorf("Expected missing [a b], got %v", errResp.Missing)
+			}
 		})
 	})
 }
\ No newline at end of file
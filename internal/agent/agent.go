@@ -7,25 +7,67 @@ import (
 	"log"
 	"math"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"calc_service/internal/proto"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
 	ErrDivisionByZero  = errors.New("division by zero")
+	ErrModuloByZero    = errors.New("modulo by zero")
+	ErrDomain          = errors.New("domain error")
 	ErrInvalidOperator = errors.New("invalid operator")
 )
 
+// Version задаётся при сборке: go build -ldflags "-X calc_service/internal/agent.Version=1.2.0".
+var Version = "dev"
+
+// Operations — операции, которые умеет выполнять Calculations.
+var Operations = []string{
+	"+", "-", "*", "/", "//", "%", "^", "neg",
+	"sqrt", "sin", "cos", "log", "abs", "round", "min", "max",
+}
+
+// Коды ошибок, которые агент передаёт оркестратору вместе с результатом задачи.
+const (
+	CodeDivisionByZero  = "division_by_zero"
+	CodeModuloByZero    = "modulo_by_zero"
+	CodeDomain          = "domain"
+	CodeOverflow        = "overflow"
+	CodeInvalidOperator = "invalid_operator"
+	CodeInternal        = "internal"
+)
+
+// ErrorCode сопоставляет ошибку Calculations с кодом для ResultRequest.
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrDivisionByZero):
+		return CodeDivisionByZero
+	case errors.Is(err, ErrModuloByZero):
+		return CodeModuloByZero
+	case errors.Is(err, ErrDomain):
+		return CodeDomain
+	case errors.Is(err, ErrInvalidOperator):
+		return CodeInvalidOperator
+	default:
+		return CodeInternal
+	}
+}
+
 type Agent struct {
+	ID              string
 	ComputingPower  int
+	Operations      []string
+	Weights         map[string]int32
 	OrchestratorURL string
-	Conn            *grpc.ClientConn
-	Client          proto.CalculatorClient
+	Transport       Transport
 }
 
 func NewAgent() *Agent {
@@ -37,79 +79,377 @@ func NewAgent() *Agent {
 	orchestratorURL := os.Getenv("ORCHESTRATOR_URL")
 	if orchestratorURL == "" {
 		orchestratorURL = "localhost:50051"
+		if os.Getenv("AGENT_TRANSPORT") == "http" {
+			orchestratorURL = "http://localhost:8080"
+		}
+	}
+
+	id := agentID()
+	if id == "" {
+		log.Println("AGENT_ID не задан: оркестратор определит ID агента по токену или сертификату")
+	}
+
+	ops, err := ParseOperations(os.Getenv("AGENT_OPERATIONS"))
+	if err != nil {
+		log.Fatalf("Неверное значение AGENT_OPERATIONS: %v", err)
+	}
+	weights, err := ParseWeights(os.Getenv("AGENT_OPERATION_WEIGHTS"))
+	if err != nil {
+		log.Fatalf("Неверное значение AGENT_OPERATION_WEIGHTS: %v", err)
 	}
 
-	conn, err := grpc.Dial(
-		orchestratorURL,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(),
-		grpc.WithTimeout(5*time.Second),
-	)
+	transport, err := NewTransport(os.Getenv("AGENT_TRANSPORT"), orchestratorURL)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 		return nil
 	}
 
-	client := proto.NewCalculatorClient(conn)
-
 	return &Agent{
+		ID:              id,
 		ComputingPower:  cp,
+		Operations:      ops,
+		Weights:         weights,
 		OrchestratorURL: orchestratorURL,
-		Conn:            conn,
-		Client:          client,
+		Transport:       transport,
+	}
+}
+
+// agentID возвращает AGENT_ID, а если он не задан — <hostname>-<pid>. Агент
+// с AGENT_TOKEN или клиентским сертификатом без AGENT_ID получает пустой ID:
+// оркестратор примет только ID из токена или CN сертификата и возьмёт его сам.
+func agentID() string {
+	if id := os.Getenv("AGENT_ID"); id != "" {
+		return id
+	}
+	if os.Getenv("AGENT_TOKEN") != "" || os.Getenv("GRPC_TLS_CERT") != "" {
+		return ""
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// ParseOperations разбирает список операций через запятую. Пустая строка означает
+// все операции из Operations.
+func ParseOperations(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return Operations, nil
+	}
+	var ops []string
+	for _, op := range strings.Split(s, ",") {
+		op = strings.TrimSpace(op)
+		if !slices.Contains(Operations, op) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidOperator, op)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// ParseWeights разбирает веса операций в формате "op=w,op=w". Чем больше вес,
+// тем охотнее оркестратор выдаёт агенту задачи с этой операцией.
+func ParseWeights(s string) (map[string]int32, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
 	}
+	weights := make(map[string]int32)
+	for _, pair := range strings.Split(s, ",") {
+		op, w, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("expected op=weight, got %q", pair)
+		}
+		if !slices.Contains(Operations, op) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidOperator, op)
+		}
+		n, err := strconv.ParseInt(w, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("weight for %q: %w", op, err)
+		}
+		weights[op] = int32(n)
+	}
+	return weights, nil
 }
 
+// Start регистрирует агента и запускает ComputingPower воркеров. Задачи приходят
+// через поток StreamTasks, а результаты отправляются пачками по мере готовности.
+// Регистрация выполняется до получения задач, чтобы оркестратор знал, какие
+// операции можно выдавать агенту.
 func (a *Agent) Start() {
-	defer a.Conn.Close()
+	defer a.Transport.Close()
+
+	if interval, ok := a.register(); ok {
+		go a.heartbeat(interval)
+	}
+
+	tasks := make(chan *proto.TaskResponse)
+	results := make(chan *proto.ResultRequest, a.ComputingPower)
+	idle := make(chan struct{}, a.ComputingPower)
 
 	for i := 0; i < a.ComputingPower; i++ {
 		log.Printf("Запускается worker %d", i)
-		go a.Worker(i)
+		idle <- struct{}{}
+		go a.Worker(i, tasks, results, idle)
+	}
+
+	go a.submitResults(results)
+	a.streamTasks(tasks, idle)
+}
+
+// Паузы перед повторными вызовами оркестратора.
+const (
+	idleWait   = time.Second // задач нет
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// retryDelay решает по коду ошибки, как реагировать на неудачный вызов оркестратора:
+// подождать новых задач, повторить с нарастающей паузой или остановить агента
+// (fatal), если повтор ничего не изменит — например, при неверном токене.
+// Пауза из RetryInfo, если оркестратор её прислал, важнее собственной.
+func retryDelay(err error, attempt int) (delay time.Duration, fatal bool) {
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.NotFound:
+		return idleWait, false
+	case codes.Unauthenticated, codes.PermissionDenied, codes.InvalidArgument:
+		return 0, true
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration(), false
+		}
 	}
+	return min(minBackoff<<min(attempt, 5), maxBackoff), false
+}
 
-	select {}
+// register регистрирует агента в оркестраторе, повторяя попытки до успеха,
+// и возвращает интервал, с которым нужно присылать Heartbeat. Если транспорт
+// не поддерживает регистрацию, агент работает без неё.
+func (a *Agent) register() (time.Duration, bool) {
+	hostname, _ := os.Hostname()
+	for attempt := 0; ; attempt++ {
+		ack, err := a.Transport.Register(context.Background(), &proto.AgentInfo{
+			AgentId:    a.ID,
+			Hostname:   hostname,
+			Version:    Version,
+			Workers:    int32(a.ComputingPower),
+			Operations: a.Operations,
+			Weights:    a.Weights,
+		})
+		if err == nil {
+			log.Printf("Агент %s зарегистрирован в оркестраторе", a.ID)
+			return heartbeatInterval(ack), true
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Регистрация агента не поддерживается: %v", err)
+			return 0, false
+		}
+		delay, fatal := retryDelay(err, attempt)
+		if fatal {
+			log.Fatalf("Оркестратор отклонил регистрацию агента: %v", err)
+		}
+		log.Printf("Ошибка при регистрации агента: %v", err)
+		time.Sleep(delay)
+	}
+}
+
+// heartbeat сообщает оркестратору, что агент жив. Если оркестратор забыл агента
+// (например, после перезапуска), агент регистрируется заново.
+func (a *Agent) heartbeat(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		ack, err := a.Transport.Heartbeat(context.Background(), a.ID)
+		switch {
+		case errors.Is(err, ErrNotRegistered):
+			interval, _ = a.register()
+		case err != nil:
+			if _, fatal := retryDelay(err, 0); fatal {
+				log.Fatalf("Оркестратор отклонил heartbeat: %v", err)
+			}
+			log.Printf("Ошибка при отправке heartbeat: %v", err)
+		default:
+			interval = heartbeatInterval(ack)
+		}
+	}
+}
+
+func heartbeatInterval(ack *proto.AgentAck) time.Duration {
+	if ack.HeartbeatIntervalMs <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(ack.HeartbeatIntervalMs) * time.Millisecond
 }
 
-func (a *Agent) Worker(id int) {
+// streamTasks получает задачи из потока StreamTasks и переподключается при обрыве.
+// Если оркестратор не поддерживает поток, агент переходит на опрос GetTasks.
+func (a *Agent) streamTasks(tasks chan<- *proto.TaskResponse, idle chan struct{}) {
+	attempt := 0
 	for {
-		task, err := a.Client.GetTask(context.Background(), &proto.TaskRequest{
+		stream, err := a.Transport.StreamTasks(context.Background(), &proto.TaskRequest{
 			ComputingPower: int32(a.ComputingPower),
+			AgentId:        a.ID,
+			Operations:     a.Operations,
 		})
+		received := 0
+		if err == nil {
+			received, err = a.receiveTasks(stream, tasks, idle)
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Поток задач не поддерживается, переходим на опрос")
+			a.fetchTasks(tasks, idle)
+			return
+		}
+		if received > 0 {
+			attempt = 0
+		}
+
+		delay, fatal := retryDelay(err, attempt)
+		if fatal {
+			log.Fatalf("Оркестратор отклонил поток задач: %v", err)
+		}
+		log.Printf("Поток задач прерван: %v", err)
+		time.Sleep(delay)
+		attempt++
+	}
+}
+
+// receiveTasks передаёт задачи из потока воркерам и возвращает их число
+// вместе с ошибкой, которой поток завершился.
+func (a *Agent) receiveTasks(stream TaskStream, tasks chan<- *proto.TaskResponse, idle chan struct{}) (int, error) {
+	for received := 0; ; received++ {
+		task, err := stream.Recv()
 		if err != nil {
-			log.Printf("Worker %d: ошибка в получении задачи: %v", id, err)
-			time.Sleep(2 * time.Second)
-			continue
+			return received, err
 		}
+		// Оркестратор присылает задачи только под свободные воркеры,
+		// поэтому ожидание здесь короткое.
+		<-idle
+		tasks <- task
+	}
+}
 
-		if task.Id == "" {
-			time.Sleep(1 * time.Second)
+// fetchTasks ждёт хотя бы одного свободного воркера и запрашивает задачи
+// сразу для всех свободных.
+func (a *Agent) fetchTasks(tasks chan<- *proto.TaskResponse, idle chan struct{}) {
+	attempt := 0
+	for {
+		<-idle
+		free := 1
+		for free < a.ComputingPower && len(idle) > 0 {
+			<-idle
+			free++
+		}
+
+		batch, err := a.Transport.GetTasks(context.Background(), &proto.TaskRequest{
+			ComputingPower: int32(free),
+			AgentId:        a.ID,
+			Operations:     a.Operations,
+		})
+		if err != nil {
+			release(idle, free)
+			delay, fatal := retryDelay(err, attempt)
+			if fatal {
+				log.Fatalf("Оркестратор отклонил запрос задач: %v", err)
+			}
+			if status.Code(err) != codes.NotFound {
+				log.Printf("Ошибка в получении задач: %v", err)
+				attempt++
+			}
+			time.Sleep(delay)
 			continue
 		}
+		attempt = 0
 
-		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+		for _, task := range batch {
+			tasks <- task
+		}
+		release(idle, free-len(batch))
 
-		result, err := Calculations(task.Operation, task.Arg1, task.Arg2)
-		if err != nil {
-			log.Printf("Worker %d: ошибка в выполнении %s: %v", id, task.Id, err)
+		if len(batch) == 0 {
+			time.Sleep(idleWait)
+		}
+	}
+}
 
-			_, _ = a.Client.SubmitResult(context.Background(), &proto.ResultRequest{
-				Id:     task.Id,
-				Result: math.NaN(),
-			})
-			continue
+func release(idle chan<- struct{}, n int) {
+	for i := 0; i < n; i++ {
+		idle <- struct{}{}
+	}
+}
+
+// submitResults отправляет одним вызовом все результаты, накопившиеся к моменту отправки.
+func (a *Agent) submitResults(results <-chan *proto.ResultRequest) {
+	for r := range results {
+		batch := []*proto.ResultRequest{r}
+		for len(results) > 0 {
+			batch = append(batch, <-results)
 		}
 
-		_, err = a.Client.SubmitResult(context.Background(), &proto.ResultRequest{
-			Id:     task.Id,
-			Result: result,
-		})
+		for _, id := range a.submitBatch(batch, results) {
+			log.Printf("Оркестратор не принял результат задания %s", id)
+		}
+	}
+}
+
+// submitBatch отправляет пачку результатов, повторяя попытки, пока оркестратор
+// её не примет, и возвращает ID окончательно отклонённых результатов. Результаты,
+// не принятые из-за временного сбоя, отправляются снова вместе с результатами,
+// готовыми к следующей попытке.
+func (a *Agent) submitBatch(batch []*proto.ResultRequest, results <-chan *proto.ResultRequest) []string {
+	var failed []string
+	for attempt := 0; ; attempt++ {
+		resp, err := a.Transport.SubmitResults(context.Background(), batch)
+		if err == nil {
+			failed = append(failed, resp.FailedIds...)
+			if len(resp.RetryIds) == 0 {
+				return failed
+			}
+			batch = retryResults(batch, resp.RetryIds)
+			err = status.Error(codes.Unavailable, "results temporarily rejected")
+		}
+		delay, fatal := retryDelay(err, attempt)
+		if fatal {
+			log.Fatalf("Оркестратор отклонил результаты: %v", err)
+		}
+		log.Printf("Ошибка при отправке %d результатов: %v", len(batch), err)
+		time.Sleep(delay)
+		for len(results) > 0 {
+			batch = append(batch, <-results)
+		}
+	}
+}
+
+// retryResults оставляет в пачке результаты с ID из ids.
+func retryResults(batch []*proto.ResultRequest, ids []string) []*proto.ResultRequest {
+	retry := make([]*proto.ResultRequest, 0, len(ids))
+	for _, r := range batch {
+		if slices.Contains(ids, r.Id) {
+			retry = append(retry, r)
+		}
+	}
+	return retry
+}
+
+func (a *Agent) Worker(id int, tasks <-chan *proto.TaskResponse, results chan<- *proto.ResultRequest, idle chan<- struct{}) {
+	for task := range tasks {
+		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+
+		result, err := Calculations(task.Operation, task.Arg1, task.Arg2)
 		if err != nil {
-			log.Printf("Worker %d: ошибка при отправке результата для задания %s: %v", id, task.Id, err)
+			log.Printf("Worker %d: ошибка в выполнении %s: %v", id, task.Id, err)
+			results <- &proto.ResultRequest{
+				Id:           task.Id,
+				ErrorCode:    ErrorCode(err),
+				ErrorMessage: err.Error(),
+			}
 		} else {
 			log.Printf("Worker %d: завершена задача %s: %.2f %s %.2f = %.2f",
 				id, task.Id, task.Arg1, task.Operation, task.Arg2, result)
+			results <- &proto.ResultRequest{
+				Id:     task.Id,
+				Result: result,
+			}
 		}
+		idle <- struct{}{}
 	}
 }
 
@@ -130,7 +470,49 @@ func Calculations(operation string, a, b float64) (float64, error) {
 			return 0, ErrDivisionByZero
 		}
 		return a / b, nil
+	case "//":
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Floor(a / b), nil
+	case "%":
+		if b == 0 {
+			return 0, ErrModuloByZero
+		}
+		return a - b*math.Floor(a/b), nil
+	case "^":
+		if a == 0 && b < 0 {
+			return 0, ErrDivisionByZero
+		}
+		if a < 0 && b != math.Trunc(b) {
+			return 0, fmt.Errorf("%w: negative base with fractional exponent", ErrDomain)
+		}
+		return math.Pow(a, b), nil
+	case "neg":
+		return -a, nil
+	case "sqrt":
+		if a < 0 {
+			return 0, fmt.Errorf("%w: square root of negative number", ErrDomain)
+		}
+		return math.Sqrt(a), nil
+	case "sin":
+		return math.Sin(a), nil
+	case "cos":
+		return math.Cos(a), nil
+	case "log":
+		if a <= 0 {
+			return 0, fmt.Errorf("%w: logarithm of non-positive number", ErrDomain)
+		}
+		return math.Log(a), nil
+	case "abs":
+		return math.Abs(a), nil
+	case "round":
+		return math.Round(a), nil
+	case "min":
+		return math.Min(a, b), nil
+	case "max":
+		return math.Max(a, b), nil
 	default:
-		return 0, fmt.Errorf("invalid operator: %s", operation)
+		return 0, fmt.Errorf("%w: %s", ErrInvalidOperator, operation)
 	}
 }
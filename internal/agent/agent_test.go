@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -101,6 +102,162 @@ func TestCalculations(t *testing.T) {
 			err:       ErrDivisionByZero,
 		},
 
+		{
+			name:      "Целочисленное деление",
+			operation: "//",
+			a:         7.0,
+			b:         2.0,
+			expected:  3.0,
+			expectErr: false,
+		},
+		{
+			name:      "Целочисленное деление отрицательного числа",
+			operation: "//",
+			a:         -7.0,
+			b:         2.0,
+			expected:  -4.0,
+			expectErr: false,
+		},
+		{
+			name:      "Целочисленное деление на нуль",
+			operation: "//",
+			a:         7.0,
+			b:         0.0,
+			expected:  0.0,
+			expectErr: true,
+			err:       ErrDivisionByZero,
+		},
+
+		{
+			name:      "Остаток от деления",
+			operation: "%",
+			a:         7.0,
+			b:         3.0,
+			expected:  1.0,
+			expectErr: false,
+		},
+		{
+			name:      "Остаток от деления отрицательного числа",
+			operation: "%",
+			a:         -7.0,
+			b:         3.0,
+			expected:  2.0,
+			expectErr: false,
+		},
+		{
+			name:      "Остаток от деления на нуль",
+			operation: "%",
+			a:         7.0,
+			b:         0.0,
+			expected:  0.0,
+			expectErr: true,
+			err:       ErrModuloByZero,
+		},
+
+		{
+			name:      "Возведение в степень",
+			operation: "^",
+			a:         2.0,
+			b:         10.0,
+			expected:  1024.0,
+			expectErr: false,
+		},
+		{
+			name:      "Отрицательное основание с целой степенью",
+			operation: "^",
+			a:         -2.0,
+			b:         3.0,
+			expected:  -8.0,
+			expectErr: false,
+		},
+		{
+			name:      "Отрицательное основание с дробной степенью",
+			operation: "^",
+			a:         -8.0,
+			b:         0.5,
+			expected:  0.0,
+			expectErr: true,
+			err:       fmt.Errorf("%w: negative base with fractional exponent", ErrDomain),
+		},
+		{
+			name:      "Нуль в отрицательной степени",
+			operation: "^",
+			a:         0.0,
+			b:         -1.0,
+			expected:  0.0,
+			expectErr: true,
+			err:       ErrDivisionByZero,
+		},
+
+		{
+			name:      "Унарный минус",
+			operation: "neg",
+			a:         2.5,
+			expected:  -2.5,
+			expectErr: false,
+		},
+		{
+			name:      "Унарный минус отрицательного числа",
+			operation: "neg",
+			a:         -4.0,
+			expected:  4.0,
+			expectErr: false,
+		},
+
+		{
+			name:      "Квадратный корень",
+			operation: "sqrt",
+			a:         9.0,
+			expected:  3.0,
+			expectErr: false,
+		},
+		{
+			name:      "Квадратный корень отрицательного числа",
+			operation: "sqrt",
+			a:         -9.0,
+			expected:  0.0,
+			expectErr: true,
+			err:       fmt.Errorf("%w: square root of negative number", ErrDomain),
+		},
+		{
+			name:      "Логарифм нуля",
+			operation: "log",
+			a:         0.0,
+			expected:  0.0,
+			expectErr: true,
+			err:       fmt.Errorf("%w: logarithm of non-positive number", ErrDomain),
+		},
+		{
+			name:      "Модуль",
+			operation: "abs",
+			a:         -2.5,
+			expected:  2.5,
+			expectErr: false,
+		},
+		{
+			name:      "Округление",
+			operation: "round",
+			a:         2.5,
+			expected:  3.0,
+			expectErr: false,
+		},
+		{
+			name:      "Минимум",
+			operation: "min",
+			a:         2.0,
+			b:         -3.0,
+			expected:  -3.0,
+			expectErr: false,
+		},
+		{
+			name:      "Максимум",
+			operation: "max",
+			a:         2.0,
+			b:         -3.0,
+			expected:  2.0,
+			expectErr: false,
+		},
+
 		{
 			name:      "Invalid operator",
 			operation: "$",
@@ -134,3 +291,93 @@ func TestCalculations(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		a, b      float64
+		code      string
+	}{
+		{"Деление на ноль", "/", 1, 0, CodeDivisionByZero},
+		{"Остаток от деления на ноль", "%", 1, 0, CodeModuloByZero},
+		{"Корень из отрицательного числа", "sqrt", -1, 0, CodeDomain},
+		{"Неизвестный оператор", "$", 1, 1, CodeInvalidOperator},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Calculations(tt.operation, tt.a, tt.b)
+			if code := ErrorCode(err); code != tt.code {
+				t.Errorf("expected code: %s, got: %s", tt.code, code)
+			}
+		})
+	}
+
+	if code := ErrorCode(fmt.Errorf("connection reset")); code != CodeInternal {
+		t.Errorf("expected code: %s, got: %s", CodeInternal, code)
+	}
+}
+
+func TestOperationsSupported(t *testing.T) {
+	for _, op := range Operations {
+		if _, err := Calculations(op, 4, 2); errors.Is(err, ErrInvalidOperator) {
+			t.Errorf("operation %q is advertised but not supported", op)
+		}
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	ops, err := ParseOperations("")
+	if err != nil || len(ops) != len(Operations) {
+		t.Errorf("пустой список должен означать все операции, имеем: %v, %v", ops, err)
+	}
+	ops, err = ParseOperations("+, *")
+	if err != nil || len(ops) != 2 || ops[0] != "+" || ops[1] != "*" {
+		t.Errorf("неверный разбор операций: %v, %v", ops, err)
+	}
+	if _, err := ParseOperations("+,foo"); !errors.Is(err, ErrInvalidOperator) {
+		t.Errorf("ожидалась ошибка неизвестной операции, имеем: %v", err)
+	}
+
+	weights, err := ParseWeights("+=1, *=10")
+	if err != nil || weights["+"] != 1 || weights["*"] != 10 {
+		t.Errorf("неверный разбор весов: %v, %v", weights, err)
+	}
+	for _, s := range []string{"+", "+=x", "foo=1"} {
+		if _, err := ParseWeights(s); err == nil {
+			t.Errorf("ParseWeights(%q): ожидалась ошибка", s)
+		}
+	}
+}
+
+func TestAgentID(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		token    string
+		cert     string
+		expected string
+	}{
+		{"Явный ID", "agent-1", "secret", "", "agent-1"},
+		{"ID из токена", "", "secret", "", ""},
+		{"ID из сертификата", "", "", "agent.crt", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AGENT_ID", tt.id)
+			t.Setenv("AGENT_TOKEN", tt.token)
+			t.Setenv("GRPC_TLS_CERT", tt.cert)
+			if id := agentID(); id != tt.expected {
+				t.Errorf("ожидался ID %q, имеем %q", tt.expected, id)
+			}
+		})
+	}
+
+	t.Setenv("AGENT_ID", "")
+	t.Setenv("AGENT_TOKEN", "")
+	t.Setenv("GRPC_TLS_CERT", "")
+	if id := agentID(); id == "" {
+		t.Errorf("без токена и сертификата ожидался ID <hostname>-<pid>")
+	}
+}
@@ -0,0 +1,381 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"calc_service/internal/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNotRegistered — оркестратор не знает агента, нужно зарегистрироваться заново.
+var ErrNotRegistered = errors.New("agent is not registered")
+
+// Transport — способ связи агента с оркестратором. Если оркестратор или транспорт
+// не поддерживает вызов, возвращается ошибка, оборачивающая errors.ErrUnsupported.
+type Transport interface {
+	Register(ctx context.Context, info *proto.AgentInfo) (*proto.AgentAck, error)
+	Heartbeat(ctx context.Context, agentID string) (*proto.AgentAck, error)
+	StreamTasks(ctx context.Context, req *proto.TaskRequest) (TaskStream, error)
+	GetTasks(ctx context.Context, req *proto.TaskRequest) ([]*proto.TaskResponse, error)
+	// SubmitResults возвращает ID задач, результаты которых оркестратор отклонил
+	// окончательно (FailedIds) или из-за временного сбоя (RetryIds).
+	SubmitResults(ctx context.Context, results []*proto.ResultRequest) (*proto.ResultBatchResponse, error)
+	Close() error
+}
+
+// TaskStream — поток задач, которые оркестратор отправляет агенту.
+type TaskStream interface {
+	Recv() (*proto.TaskResponse, error)
+}
+
+// NewTransport создаёт транспорт по AGENT_TRANSPORT: grpc (по умолчанию) или http.
+func NewTransport(kind, orchestratorURL string) (Transport, error) {
+	cfg, err := clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("AGENT_TOKEN")
+
+	switch kind {
+	case "", "grpc":
+		return newGRPCTransport(orchestratorURL, cfg, token)
+	case "http":
+		return newHTTPTransport(orchestratorURL, cfg, token)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", kind)
+	}
+}
+
+// clientTLSConfig включает TLS, если задан GRPC_TLS_CA — сертификат CA оркестратора.
+// С GRPC_TLS_CERT и GRPC_TLS_KEY агент предъявляет свой сертификат (mTLS).
+func clientTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("GRPC_TLS_CA")
+	if caFile == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	cfg := &tls.Config{
+		RootCAs:    pool,
+		ServerName: os.Getenv("GRPC_TLS_SERVER_NAME"),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if certFile := os.Getenv("GRPC_TLS_CERT"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("GRPC_TLS_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("load client key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+type grpcTransport struct {
+	conn   *grpc.ClientConn
+	client proto.CalculatorClient
+}
+
+func newGRPCTransport(target string, cfg *tls.Config, token string) (*grpcTransport, error) {
+	creds := insecure.NewCredentials()
+	if cfg != nil {
+		creds = credentials.NewTLS(cfg)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithBlock(),
+		grpc.WithTimeout(5 * time.Second),
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: token, secure: cfg != nil}))
+	}
+
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcTransport{conn: conn, client: proto.NewCalculatorClient(conn)}, nil
+}
+
+// grpcError переводит Unimplemented в ошибку, общую для всех транспортов.
+func grpcError(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("%w: %v", errors.ErrUnsupported, err)
+	}
+	return err
+}
+
+func (t *grpcTransport) Register(ctx context.Context, info *proto.AgentInfo) (*proto.AgentAck, error) {
+	ack, err := t.client.RegisterAgent(ctx, info)
+	return ack, grpcError(err)
+}
+
+func (t *grpcTransport) Heartbeat(ctx context.Context, agentID string) (*proto.AgentAck, error) {
+	ack, err := t.client.Heartbeat(ctx, &proto.HeartbeatRequest{AgentId: agentID})
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("%w: %v", ErrNotRegistered, err)
+	}
+	return ack, grpcError(err)
+}
+
+func (t *grpcTransport) StreamTasks(ctx context.Context, req *proto.TaskRequest) (TaskStream, error) {
+	stream, err := t.client.StreamTasks(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcTaskStream{stream}, nil
+}
+
+// grpcTaskStream нужен потому, что о неподдерживаемом потоке сервер сообщает
+// только при первом Recv.
+type grpcTaskStream struct {
+	grpc.ServerStreamingClient[proto.TaskResponse]
+}
+
+func (s grpcTaskStream) Recv() (*proto.TaskResponse, error) {
+	task, err := s.ServerStreamingClient.Recv()
+	return task, grpcError(err)
+}
+
+func (t *grpcTransport) GetTasks(ctx context.Context, req *proto.TaskRequest) ([]*proto.TaskResponse, error) {
+	batch, err := t.client.GetTasks(ctx, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return batch.Tasks, nil
+}
+
+func (t *grpcTransport) SubmitResults(ctx context.Context, results []*proto.ResultRequest) (*proto.ResultBatchResponse, error) {
+	resp, err := t.client.SubmitResults(ctx, &proto.ResultBatch{Results: results})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return resp, nil
+}
+
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+// tokenCredentials передаёт AGENT_TOKEN в метаданных каждого вызова.
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+// RequireTransportSecurity запрещает отправлять токен по открытому каналу, если настроен TLS.
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
+
+// httpTransport работает через /api/v1/internal/task оркестратора: задачи берутся
+// и результаты отправляются по одной. Регистрации и потока задач в HTTP нет.
+type httpTransport struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newHTTPTransport(baseURL string, cfg *tls.Config, token string) (*httpTransport, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("parse orchestrator URL: %w", err)
+	}
+	return &httpTransport{
+		baseURL: baseURL,
+		token:   token,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: cfg},
+		},
+	}, nil
+}
+
+func (t *httpTransport) Register(ctx context.Context, info *proto.AgentInfo) (*proto.AgentAck, error) {
+	return nil, fmt.Errorf("%w: agent registration over HTTP", errors.ErrUnsupported)
+}
+
+func (t *httpTransport) Heartbeat(ctx context.Context, agentID string) (*proto.AgentAck, error) {
+	return nil, fmt.Errorf("%w: heartbeat over HTTP", errors.ErrUnsupported)
+}
+
+func (t *httpTransport) StreamTasks(ctx context.Context, req *proto.TaskRequest) (TaskStream, error) {
+	return nil, fmt.Errorf("%w: task stream over HTTP", errors.ErrUnsupported)
+}
+
+func (t *httpTransport) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.baseURL+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.client.Do(req)
+}
+
+// GetTasks запрашивает задачи по одной, пока не наберёт ComputingPower
+// или пока очередь не опустеет.
+func (t *httpTransport) GetTasks(ctx context.Context, req *proto.TaskRequest) ([]*proto.TaskResponse, error) {
+	query := url.Values{"agent_id": {req.AgentId}}
+	if len(req.Operations) > 0 {
+		query.Set("operations", strings.Join(req.Operations, ","))
+	}
+	path := "/api/v1/internal/task?" + query.Encode()
+
+	var tasks []*proto.TaskResponse
+	for len(tasks) < int(req.ComputingPower) {
+		task, err := t.getTask(ctx, path)
+		if err != nil {
+			if len(tasks) > 0 {
+				break
+			}
+			return nil, err
+		}
+		if task == nil {
+			break
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+func (t *httpTransport) getTask(ctx context.Context, path string) (*proto.TaskResponse, error) {
+	resp, err := t.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, status.Errorf(httpCode(resp.StatusCode), "get task: %s", resp.Status)
+	}
+
+	var body struct {
+		Task struct {
+			ID            string  `json:"id"`
+			Arg1          float64 `json:"arg1"`
+			Arg2          float64 `json:"arg2"`
+			Operation     string  `json:"operation"`
+			OperationTime int     `json:"operation_time"`
+		} `json:"task"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode task: %w", err)
+	}
+	return &proto.TaskResponse{
+		Id:            body.Task.ID,
+		Arg1:          body.Task.Arg1,
+		Arg2:          body.Task.Arg2,
+		Operation:     body.Task.Operation,
+		OperationTime: int32(body.Task.OperationTime),
+	}, nil
+}
+
+func (t *httpTransport) SubmitResults(ctx context.Context, results []*proto.ResultRequest) (*proto.ResultBatchResponse, error) {
+	batch := &proto.ResultBatchResponse{}
+	for _, r := range results {
+		r = finiteResult(r)
+		resp, err := t.do(ctx, http.MethodPost, "/api/v1/internal/task", map[string]interface{}{
+			"id":            r.Id,
+			"result":        r.Result,
+			"error_code":    r.ErrorCode,
+			"error_message": r.ErrorMessage,
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		switch code := httpCode(resp.StatusCode); {
+		case resp.StatusCode == http.StatusOK:
+			batch.Accepted++
+		case code == codes.Unauthenticated:
+			return nil, status.Errorf(code, "submit result: %s", resp.Status)
+		case code == codes.Unavailable:
+			batch.RetryIds = append(batch.RetryIds, r.Id)
+		default:
+			batch.FailedIds = append(batch.FailedIds, r.Id)
+		}
+	}
+	return batch, nil
+}
+
+// finiteResult заменяет NaN и бесконечность, не представимые в JSON, ошибкой
+// domain или overflow — с той же причиной оркестратор завершает выражение,
+// получив такой результат по gRPC.
+func finiteResult(r *proto.ResultRequest) *proto.ResultRequest {
+	if r.ErrorCode != "" || !(math.IsNaN(r.Result) || math.IsInf(r.Result, 0)) {
+		return r
+	}
+	code := CodeOverflow
+	if math.IsNaN(r.Result) {
+		code = CodeDomain
+	}
+	return &proto.ResultRequest{
+		Id:           r.Id,
+		ErrorCode:    code,
+		ErrorMessage: fmt.Sprintf("non-finite result %v", r.Result),
+	}
+}
+
+// httpCode сопоставляет HTTP-статус ответа оркестратора с кодом gRPC, чтобы агент
+// одинаково обрабатывал ошибки обоих транспортов.
+func httpCode(code int) codes.Code {
+	switch code {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+func (t *httpTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"calc_service/internal/proto"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	queue := []string{`{"task":{"id":"7","arg1":2,"arg2":3,"operation":"*","operation_time":10}}`}
+	var submitted []map[string]interface{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/internal/task" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, `{"error":"Доступ запрещён"}`, http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("agent_id") != "agent-1" || r.URL.Query().Get("operations") != "*,+" || len(queue) == 0 {
+				http.Error(w, `{"error":"No task available"}`, http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(queue[0]))
+			queue = queue[1:]
+		case http.MethodPost:
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			submitted = append(submitted, body)
+			switch body["id"] {
+			case "missing":
+				http.Error(w, `{"error":"Не удалось выполнить задание"}`, http.StatusInternalServerError)
+			case "busy":
+				http.Error(w, `{"error":"Не удалось выполнить задание"}`, http.StatusServiceUnavailable)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	tr, err := newHTTPTransport(srv.URL, nil, "secret")
+	if err != nil {
+		t.Fatalf("newHTTPTransport не удалось: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := tr.Register(ctx, &proto.AgentInfo{AgentId: "agent-1"}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("ожидалась ErrUnsupported для регистрации, имеем: %v", err)
+	}
+	if _, err := tr.StreamTasks(ctx, &proto.TaskRequest{}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("ожидалась ErrUnsupported для потока задач, имеем: %v", err)
+	}
+
+	tasks, err := tr.GetTasks(ctx, &proto.TaskRequest{ComputingPower: 4, AgentId: "agent-1", Operations: []string{"*", "+"}})
+	if err != nil {
+		t.Fatalf("GetTasks не удалось: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != "7" || tasks[0].Arg1 != 2 || tasks[0].Arg2 != 3 ||
+		tasks[0].Operation != "*" || tasks[0].OperationTime != 10 {
+		t.Fatalf("неверные задачи: %+v", tasks)
+	}
+
+	resp, err := tr.SubmitResults(ctx, []*proto.ResultRequest{
+		{Id: "7", Result: 6},
+		{Id: "8", ErrorCode: CodeDivisionByZero, ErrorMessage: "division by zero"},
+		{Id: "9", Result: math.Inf(1)},
+		{Id: "10", Result: math.NaN()},
+		{Id: "missing", Result: 1},
+		{Id: "busy", Result: 1},
+	})
+	if err != nil {
+		t.Fatalf("SubmitResults не удалось: %v", err)
+	}
+	if resp.Accepted != 4 || len(resp.FailedIds) != 1 || resp.FailedIds[0] != "missing" {
+		t.Errorf("неверный список непринятых результатов: %v", resp)
+	}
+	if len(resp.RetryIds) != 1 || resp.RetryIds[0] != "busy" {
+		t.Errorf("ответ 503 должен возвращать результат на повтор, имеем: %v", resp.RetryIds)
+	}
+	if len(submitted) != 6 || submitted[0]["result"] != 6.0 || submitted[1]["error_code"] != CodeDivisionByZero {
+		t.Fatalf("неверные отправленные результаты: %v", submitted)
+	}
+	if submitted[2]["id"] != "9" || submitted[2]["error_code"] != CodeOverflow {
+		t.Errorf("бесконечность должна отправляться как ошибка %s, имеем: %v", CodeOverflow, submitted[2])
+	}
+	if submitted[3]["id"] != "10" || submitted[3]["error_code"] != CodeDomain {
+		t.Errorf("NaN должен отправляться как ошибка %s, имеем: %v", CodeDomain, submitted[3])
+	}
+
+	tr.token = "wrong"
+	if _, err := tr.GetTasks(ctx, &proto.TaskRequest{ComputingPower: 1, AgentId: "agent-1"}); err == nil {
+		t.Errorf("ожидалась ошибка при неверном токене")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	busy, _ := status.New(codes.Unavailable, "busy").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(3 * time.Second)})
+
+	tests := []struct {
+		name    string
+		err     error
+		attempt int
+		delay   time.Duration
+		fatal   bool
+	}{
+		{"Нет задач", status.Error(codes.NotFound, "not found"), 3, idleWait, false},
+		{"Неверный токен", status.Error(codes.Unauthenticated, "invalid token"), 0, 0, true},
+		{"Нет доступа по HTTP", status.Error(httpCode(http.StatusForbidden), "forbidden"), 0, 0, true},
+		{"Пауза от оркестратора", busy.Err(), 4, 3 * time.Second, false},
+		{"Первая ошибка", errors.New("connection refused"), 0, minBackoff, false},
+		{"Нарастающая пауза", status.Error(codes.Internal, "internal"), 2, 4 * time.Second, false},
+		{"Предел паузы", status.Error(codes.Unavailable, "unavailable"), 10, maxBackoff, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, fatal := retryDelay(tt.err, tt.attempt)
+			if delay != tt.delay || fatal != tt.fatal {
+				t.Errorf("ожидалось (%v, %v), имеем (%v, %v)", tt.delay, tt.fatal, delay, fatal)
+			}
+		})
+	}
+}
+
+// flakyTransport отклоняет первые fails вызовов SubmitResults как временную ошибку,
+// а в следующем ответе просит повторить результаты из retry.
+type flakyTransport struct {
+	Transport
+	fails     int
+	retry     []string
+	submitted [][]*proto.ResultRequest
+}
+
+func (f *flakyTransport) SubmitResults(ctx context.Context, results []*proto.ResultRequest) (*proto.ResultBatchResponse, error) {
+	f.submitted = append(f.submitted, results)
+	switch {
+	case len(f.submitted) <= f.fails:
+		busy, _ := status.New(codes.Unavailable, "busy").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Millisecond)})
+		return nil, busy.Err()
+	case len(f.submitted) == f.fails+1:
+		return &proto.ResultBatchResponse{FailedIds: []string{"missing"}, RetryIds: f.retry}, nil
+	}
+	return &proto.ResultBatchResponse{Accepted: int32(len(results))}, nil
+}
+
+func TestSubmitBatchRetries(t *testing.T) {
+	tr := &flakyTransport{fails: 2}
+	a := &Agent{Transport: tr}
+
+	results := make(chan *proto.ResultRequest, 1)
+	results <- &proto.ResultRequest{Id: "2", Result: 4}
+
+	failed := a.submitBatch([]*proto.ResultRequest{{Id: "1", Result: 2}}, results)
+	if len(failed) != 1 || failed[0] != "missing" {
+		t.Errorf("неверный список непринятых результатов: %v", failed)
+	}
+	if len(tr.submitted) != 3 {
+		t.Fatalf("пачка должна отправляться до успеха, попыток: %d", len(tr.submitted))
+	}
+	if last := tr.submitted[2]; len(last) != 2 || last[0].Id != "1" || last[1].Id != "2" {
+		t.Errorf("новые результаты должны добавляться к повторной отправке, имеем: %v", last)
+	}
+}
+
+func TestSubmitBatchRetriesBusyResults(t *testing.T) {
+	tr := &flakyTransport{retry: []string{"2"}}
+	a := &Agent{Transport: tr}
+
+	results := make(chan *proto.ResultRequest, 1)
+	failed := a.submitBatch([]*proto.ResultRequest{{Id: "1", Result: 2}, {Id: "2", Result: 4}, {Id: "missing", Result: 1}}, results)
+	if len(failed) != 1 || failed[0] != "missing" {
+		t.Errorf("неверный список непринятых результатов: %v", failed)
+	}
+	if len(tr.submitted) != 2 {
+		t.Fatalf("временно не принятые результаты должны отправляться снова, попыток: %d", len(tr.submitted))
+	}
+	if last := tr.submitted[1]; len(last) != 1 || last[0].Id != "2" {
+		t.Errorf("повторно должны отправляться только временно не принятые результаты, имеем: %v", last)
+	}
+}
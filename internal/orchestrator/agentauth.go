@@ -0,0 +1,208 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type agentIDKey struct{}
+
+// parseAgentTokens разбирает AGENT_TOKENS в формате "agent-1:secret1,agent-2:secret2"
+// и возвращает отображение токена в ID агента.
+func parseAgentTokens(s string) map[string]string {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		id, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && id != "" && token != "" {
+			tokens[token] = id
+		}
+	}
+	return tokens
+}
+
+// serverTLSConfig возвращает nil, если сертификат оркестратора не задан.
+func (o *Orchestrator) serverTLSConfig() (*tls.Config, error) {
+	if o.Config.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(o.Config.TLSCertFile, o.Config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS key pair: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if o.Config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(o.Config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", o.Config.TLSClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// grpcServerOptions включает TLS, если заданы сертификат и ключ, mTLS, если задан
+// ещё и CA клиентов. Агенты проверяются по токену из AGENT_TOKENS или по CN
+// клиентского сертификата, если задан хотя бы один из этих способов.
+// Вызовы Calculator проходят через журнал и метрики, затем через перехват паник
+// и только потом через проверку агента.
+func (o *Orchestrator) grpcServerOptions() ([]grpc.ServerOption, error) {
+	var opts []grpc.ServerOption
+
+	cfg, err := o.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+
+	unary := []grpc.UnaryServerInterceptor{o.observeUnary, recoverUnary}
+	stream := []grpc.StreamServerInterceptor{o.observeStream, recoverStream}
+	if len(o.Config.AgentTokens) > 0 || (cfg != nil && cfg.ClientCAs != nil) {
+		unary = append(unary, o.agentAuthUnary)
+		stream = append(stream, o.agentAuthStream)
+	}
+	for i := range unary {
+		unary[i] = calculatorUnary(unary[i])
+	}
+	for i := range stream {
+		stream[i] = calculatorStream(stream[i])
+	}
+
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
+	return opts, nil
+}
+
+// authenticateAgent находит агента по CN клиентского сертификата (mTLS) или по токену
+// из метаданных "authorization: Bearer <token>". Если есть и то и другое, они должны
+// указывать на одного агента — как в agentMiddleware.
+func (o *Orchestrator) authenticateAgent(ctx context.Context) (string, error) {
+	id := peerCommonName(ctx)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) > 0 {
+		tokenID, ok := o.agentByToken(strings.TrimPrefix(values[0], "Bearer "))
+		if !ok {
+			return "", status.Error(codes.Unauthenticated, "invalid agent token")
+		}
+		if id != "" && tokenID != id {
+			return "", status.Errorf(codes.PermissionDenied, "token does not belong to agent %s", id)
+		}
+		id = tokenID
+	}
+
+	if id == "" {
+		return "", status.Error(codes.Unauthenticated, "missing agent token")
+	}
+	return id, nil
+}
+
+// peerCommonName возвращает CN проверенного клиентского сертификата вызова gRPC.
+func peerCommonName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ""
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+func (o *Orchestrator) agentByToken(token string) (string, bool) {
+	for known, id := range o.Config.AgentTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (o *Orchestrator) agentAuthUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id, err := o.authenticateAgent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, agentIDKey{}, id), req)
+}
+
+func (o *Orchestrator) agentAuthStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id, err := o.authenticateAgent(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &agentStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), agentIDKey{}, id)})
+}
+
+type agentStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *agentStream) Context() context.Context {
+	return s.ctx
+}
+
+// agentIdentity возвращает ID агента, прошедшего проверку токена или сертификата.
+// Агент не может представиться чужим ID. Без проверки агентов используется ID из запроса.
+func agentIdentity(ctx context.Context, claimed string) (string, error) {
+	id, ok := ctx.Value(agentIDKey{}).(string)
+	if !ok {
+		return claimed, nil
+	}
+	if claimed != "" && claimed != id {
+		return "", status.Errorf(codes.PermissionDenied, "token does not belong to agent %s", claimed)
+	}
+	return id, nil
+}
+
+// agentMiddleware пропускает к HTTP-ручкам агентов только агентов: по токену из
+// AGENT_TOKENS или по клиентскому сертификату (mTLS), CN которого считается ID агента.
+// Токен пользователя здесь не действует.
+func (o *Orchestrator) agentMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id string
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			id = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+
+		authHeader := r.Header.Get("Authorization")
+		if authHeader != "" {
+			tokenID, ok := o.agentByToken(strings.TrimPrefix(authHeader, "Bearer "))
+			if !ok || (id != "" && tokenID != id) {
+				http.Error(w, `{"error":"Доступ запрещён"}`, http.StatusForbidden)
+				return
+			}
+			id = tokenID
+		}
+
+		if id == "" {
+			http.Error(w, `{"error":"Не авторизован"}`, http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), agentIDKey{}, id)))
+	}
+}
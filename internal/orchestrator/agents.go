@@ -0,0 +1,251 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"calc_service/internal/proto"
+	"calc_service/internal/storage"
+)
+
+// AgentInfo — агент, зарегистрированный через RegisterAgent.
+type AgentInfo struct {
+	ID           string         `json:"id"`
+	Hostname     string         `json:"hostname"`
+	Version      string         `json:"version"`
+	Workers      int            `json:"workers"`
+	Operations   []string       `json:"operations"`
+	Weights      map[string]int `json:"weights,omitempty"`
+	RegisteredAt time.Time      `json:"registered_at"`
+	LastSeen     time.Time      `json:"last_seen"`
+	LeasedTasks  int            `json:"leased_tasks"`
+}
+
+// agentRegistry хранит агентов в памяти оркестратора. Нулевое значение готово к использованию.
+type agentRegistry struct {
+	mu     sync.Mutex
+	agents map[string]*AgentInfo
+	// pollers — незарегистрированные агенты (например, работающие по HTTP):
+	// операции из их последнего запроса задач и время этого запроса.
+	pollers map[string]*poller
+}
+
+type poller struct {
+	operations []string
+	lastSeen   time.Time
+}
+
+func (r *agentRegistry) register(info *AgentInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.agents == nil {
+		r.agents = make(map[string]*AgentInfo)
+	}
+	r.agents[info.ID] = info
+	delete(r.pollers, info.ID)
+}
+
+// touch обновляет время последнего сигнала агента и сообщает, известен ли он.
+func (r *agentRegistry) touch(id string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.agents[id]
+	if ok {
+		a.LastSeen = now
+	}
+	return ok
+}
+
+// expire удаляет агентов, от которых не было сигналов дольше timeout, и возвращает
+// ID зарегистрированных. Аренды незарегистрированных агентов истекают сами.
+func (r *agentRegistry) expire(now time.Time, timeout time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []string
+	for id, a := range r.agents {
+		if now.Sub(a.LastSeen) > timeout {
+			delete(r.agents, id)
+			expired = append(expired, id)
+		}
+	}
+	for id, p := range r.pollers {
+		if now.Sub(p.lastSeen) > timeout {
+			delete(r.pollers, id)
+		}
+	}
+	return expired
+}
+
+// capabilities возвращает операции, которые можно выдавать агенту: из регистрации,
+// а для незарегистрированного агента — declared из запроса задач, которые
+// запоминаются для supports. Если агент не сообщил операции ни там, ни там,
+// ограничений нет.
+func (r *agentRegistry) capabilities(id string, declared []string) storage.Capabilities {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var weights map[string]int
+	if a, ok := r.agents[id]; ok {
+		if len(a.Operations) > 0 {
+			declared, weights = a.Operations, a.Weights
+		}
+	} else {
+		if r.pollers == nil {
+			r.pollers = make(map[string]*poller)
+		}
+		r.pollers[id] = &poller{operations: declared, lastSeen: time.Now()}
+	}
+	if len(declared) == 0 {
+		return nil
+	}
+	caps := make(storage.Capabilities, len(declared))
+	for _, op := range declared {
+		caps[op] = weights[op]
+	}
+	return caps
+}
+
+// supports сообщает, может ли операцию выполнить хотя бы один зарегистрированный
+// агент или агент, запрашивавший задачи без регистрации.
+func (r *agentRegistry) supports(op string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range r.agents {
+		if len(a.Operations) == 0 || slices.Contains(a.Operations, op) {
+			return true
+		}
+	}
+	for _, p := range r.pollers {
+		if len(p.operations) == 0 || slices.Contains(p.operations, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *agentRegistry) list() []AgentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	agents := make([]AgentInfo, 0, len(r.agents))
+	for _, a := range r.agents {
+		agents = append(agents, *a)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+// RegisterAgent регистрирует агента. Агент, прошедший проверку токена или
+// сертификата, может не передавать agent_id: используется ID из проверки.
+func (s *server) RegisterAgent(ctx context.Context, req *proto.AgentInfo) (*proto.AgentAck, error) {
+	id, err := agentIdentity(ctx, req.AgentId)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+
+	weights := make(map[string]int, len(req.Weights))
+	for op, w := range req.Weights {
+		weights[op] = int(w)
+	}
+
+	now := time.Now()
+	s.o.agents.register(&AgentInfo{
+		ID:           id,
+		Hostname:     req.Hostname,
+		Version:      req.Version,
+		Workers:      int(req.Workers),
+		Operations:   req.Operations,
+		Weights:      weights,
+		RegisteredAt: now,
+		LastSeen:     now,
+	})
+	log.Printf("Зарегистрирован агент %s (%s, версия %s, воркеров: %d)",
+		id, req.Hostname, req.Version, req.Workers)
+
+	return s.o.agentAck(), nil
+}
+
+// Heartbeat возвращает NotFound для незарегистрированного агента:
+// например, после перезапуска оркестратора агент должен зарегистрироваться заново.
+func (s *server) Heartbeat(ctx context.Context, req *proto.HeartbeatRequest) (*proto.AgentAck, error) {
+	id, err := agentIdentity(ctx, req.AgentId)
+	if err != nil {
+		return nil, err
+	}
+	if !s.o.agents.touch(id, time.Now()) {
+		return nil, status.Errorf(codes.NotFound, "agent %s is not registered", id)
+	}
+	return s.o.agentAck(), nil
+}
+
+func (o *Orchestrator) agentAck() *proto.AgentAck {
+	return &proto.AgentAck{HeartbeatIntervalMs: int32(o.Config.HeartbeatInterval.Milliseconds())}
+}
+
+// expireAgents удаляет из реестра агентов, переставших присылать Heartbeat,
+// и возвращает в очередь задачи, которые они арендовали.
+func (o *Orchestrator) expireAgents(interval time.Duration) {
+	for range time.Tick(interval) {
+		o.releaseExpiredAgents(time.Now())
+	}
+}
+
+func (o *Orchestrator) releaseExpiredAgents(now time.Time) {
+	for _, id := range o.agents.expire(now, o.Config.AgentTimeout) {
+		n, err := o.Storage.ReleaseLeases(id)
+		if err != nil {
+			log.Printf("Не удалось вернуть задачи агента %s в очередь: %v", id, err)
+			continue
+		}
+		log.Printf("Агент %s не отвечает, в очередь возвращено задач: %d", id, n)
+		if n > 0 {
+			o.tasksChanged.notify()
+		}
+	}
+}
+
+func (o *Orchestrator) agentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Неверный метод"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	agents := o.agents.list()
+	for i := range agents {
+		n, err := o.Storage.CountLeasedTasks(agents[i].ID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		agents[i].LeasedTasks = n
+	}
+
+	ready, err := o.Storage.GetReadyOperations()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	// Готовые задачи, которые не может выполнить ни один агент, остаются в очереди.
+	unroutable := make(map[string]int)
+	for op, n := range ready {
+		if !o.agents.supports(op) {
+			unroutable[op] = n
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agents":                agents,
+		"unroutable_operations": unroutable,
+	})
+}
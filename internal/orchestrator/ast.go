@@ -2,51 +2,140 @@ package orchestrator
 
 import (
 	"fmt"
-	"strconv"
+	"math"
 	"strings"
-	"unicode"
 )
 
 type ASTNode struct {
-	IsLeaf        bool
-	Value         float64
-	Operator      string
-	Left, Right   *ASTNode
-	TaskScheduled bool
+	IsLeaf        bool       `json:"leaf"`
+	Value         float64    `json:"value"`
+	Operator      string     `json:"operator,omitempty"`
+	Left          *ASTNode   `json:"left,omitempty"`
+	Right         *ASTNode   `json:"right,omitempty"`
+	Args          []*ASTNode `json:"args,omitempty"`     // аргументы вызова функции, Operator содержит её имя
+	Variable      string     `json:"variable,omitempty"` // имя переменной для листа, значение подставляет BindVariables
+	TaskID        string     `json:"task_id,omitempty"`
+	Status        string     `json:"status,omitempty"`
+	Result        *float64   `json:"result,omitempty"`
+	TaskScheduled bool       `json:"-"`
+}
+
+type arity struct {
+	min, max int // max < 0 означает произвольное число аргументов
+}
+
+var functions = map[string]arity{
+	"sqrt":  {1, 1},
+	"sin":   {1, 1},
+	"cos":   {1, 1},
+	"log":   {1, 1},
+	"abs":   {1, 1},
+	"round": {1, 1},
+	"min":   {1, -1},
+	"max":   {1, -1},
+}
+
+var constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+type UnboundVariablesError struct {
+	Names []string
+}
+
+func (e *UnboundVariablesError) Error() string {
+	return "не заданы переменные: " + strings.Join(e.Names, ", ")
+}
+
+// BindVariables подставляет значения переменных и встроенных констант в листья
+// дерева. Переменные запроса имеют приоритет над константами.
+func BindVariables(node *ASTNode, vars map[string]float64) error {
+	var missing []string
+	seen := make(map[string]bool)
+
+	var walk func(n *ASTNode)
+	walk = func(n *ASTNode) {
+		if n == nil {
+			return
+		}
+		if n.IsLeaf && n.Variable != "" {
+			if v, ok := vars[n.Variable]; ok {
+				n.Value = v
+			} else if v, ok := constants[n.Variable]; ok {
+				n.Value = v
+			} else if !seen[n.Variable] {
+				seen[n.Variable] = true
+				missing = append(missing, n.Variable)
+			}
+			return
+		}
+		walk(n.Left)
+		walk(n.Right)
+		for _, arg := range n.Args {
+			walk(arg)
+		}
+	}
+	walk(node)
+
+	if len(missing) > 0 {
+		return &UnboundVariablesError{Names: missing}
+	}
+	return nil
+}
+
+var (
+	binaryOperators = []string{"+", "-", "*", "/", "//", "%", "^"}
+	operandTokens   = []string{"число", "переменная", "функция", "(", "+", "-"}
+)
+
+func afterOperand(closing ...string) []string {
+	return append(append([]string{}, binaryOperators...), closing...)
 }
 
 func ParseAST(expression string) (*ASTNode, error) {
-	expr := strings.ReplaceAll(expression, " ", "")
-	if expr == "" {
-		return nil, fmt.Errorf("пустое выражение")
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{input: expression, tokens: tokens}
+	if p.peek().Kind == tokenEOF {
+		return nil, p.errorAt(p.peek(), "пустое выражение", operandTokens...)
 	}
-	p := &parser{input: expr, pos: 0}
 	node, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
-	if p.pos < len(p.input) {
-		return nil, fmt.Errorf("неожиданный токен на месте %d", p.pos)
+	switch tok := p.peek(); tok.Kind {
+	case tokenEOF:
+		return node, nil
+	case tokenRParen:
+		return nil, p.errorAt(tok, "лишняя закрывающая скобка", afterOperand(endOfInput)...)
+	default:
+		return nil, p.errorAt(tok, "неожиданный токен", afterOperand(endOfInput)...)
 	}
-	return node, nil
 }
 
 type parser struct {
-	input string
-	pos   int
+	input  string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
 }
 
-func (p *parser) peek() rune {
-	if p.pos < len(p.input) {
-		return rune(p.input[p.pos])
+func (p *parser) get() token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != tokenEOF {
+		p.pos++
 	}
-	return 0
+	return tok
 }
 
-func (p *parser) get() rune {
-	ch := p.peek()
-	p.pos++
-	return ch
+func (p *parser) errorAt(tok token, message string, expected ...string) error {
+	return newParseError(p.input, tok.Start, tok.Text, message, expected...)
 }
 
 func (p *parser) parseExpression() (*ASTNode, error) {
@@ -55,9 +144,9 @@ func (p *parser) parseExpression() (*ASTNode, error) {
 		return nil, err
 	}
 	for {
-		ch := p.peek()
-		if ch == '+' || ch == '-' {
-			op := string(p.get())
+		tok := p.peek()
+		if tok.is(tokenOperator, "+") || tok.is(tokenOperator, "-") {
+			op := p.get().Text
 			right, err := p.parseTerm()
 			if err != nil {
 				return nil, err
@@ -76,15 +165,15 @@ func (p *parser) parseExpression() (*ASTNode, error) {
 }
 
 func (p *parser) parseTerm() (*ASTNode, error) {
-	node, err := p.parseFactor()
+	node, err := p.parseUnary()
 	if err != nil {
 		return nil, err
 	}
 	for {
-		ch := p.peek()
-		if ch == '*' || ch == '/' {
-			op := string(p.get())
-			right, err := p.parseFactor()
+		tok := p.peek()
+		if tok.Kind == tokenOperator && (tok.Text == "*" || tok.Text == "/" || tok.Text == "//" || tok.Text == "%") {
+			op := p.get().Text
+			right, err := p.parseUnary()
 			if err != nil {
 				return nil, err
 			}
@@ -101,42 +190,125 @@ func (p *parser) parseTerm() (*ASTNode, error) {
 	return node, nil
 }
 
+func (p *parser) parseUnary() (*ASTNode, error) {
+	tok := p.peek()
+	if !tok.is(tokenOperator, "+") && !tok.is(tokenOperator, "-") {
+		return p.parsePower()
+	}
+	p.get()
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if tok.Text == "+" {
+		return operand, nil
+	}
+	if operand.IsLeaf && operand.Variable == "" {
+		return &ASTNode{
+			IsLeaf: true,
+			Value:  -operand.Value,
+		}, nil
+	}
+	return &ASTNode{
+		IsLeaf:   false,
+		Operator: "neg",
+		Left:     operand,
+	}, nil
+}
+
+func (p *parser) parsePower() (*ASTNode, error) {
+	node, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	if !p.peek().is(tokenOperator, "^") {
+		return node, nil
+	}
+	p.get()
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &ASTNode{
+		IsLeaf:   false,
+		Operator: "^",
+		Left:     node,
+		Right:    exponent,
+	}, nil
+}
+
 func (p *parser) parseFactor() (*ASTNode, error) {
-	ch := p.peek()
-	if ch == '(' {
+	tok := p.peek()
+	switch tok.Kind {
+	case tokenLParen:
 		p.get()
 		node, err := p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-		if p.peek() != ')' {
-			return nil, fmt.Errorf("нет закрывающей скобки")
+		if p.peek().Kind != tokenRParen {
+			return nil, p.errorAt(p.peek(), "нет закрывающей скобки", afterOperand(")")...)
 		}
 		p.get()
 		return node, nil
-	}
-	start := p.pos
-	if ch == '+' || ch == '-' {
+	case tokenIdent:
+		return p.parseName()
+	case tokenNumber:
 		p.get()
+		return &ASTNode{
+			IsLeaf: true,
+			Value:  tok.Value,
+		}, nil
 	}
-	for {
-		ch = p.peek()
-		if unicode.IsDigit(ch) || ch == '.' {
+	return nil, p.errorAt(tok, "ожидался операнд", operandTokens...)
+}
+
+func (p *parser) parseName() (*ASTNode, error) {
+	nameTok := p.get()
+	name := nameTok.Text
+	if p.peek().Kind != tokenLParen {
+		if _, ok := functions[name]; ok {
+			return nil, p.errorAt(p.peek(), "ожидалась скобка после функции "+name, "(")
+		}
+		return &ASTNode{
+			IsLeaf:   true,
+			Variable: name,
+		}, nil
+	}
+	ar, ok := functions[name]
+	if !ok {
+		return nil, p.errorAt(nameTok, "неизвестная функция")
+	}
+	p.get()
+
+	var args []*ASTNode
+	if p.peek().Kind != tokenRParen {
+		for {
+			arg, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek().Kind != tokenComma {
+				break
+			}
 			p.get()
-		} else {
-			break
 		}
 	}
-	token := p.input[start:p.pos]
-	if token == "" {
-		return nil, fmt.Errorf("неожиданное число на месте %d", start)
+	if p.peek().Kind != tokenRParen {
+		return nil, p.errorAt(p.peek(), "нет закрывающей скобки", afterOperand(",", ")")...)
 	}
-	value, err := strconv.ParseFloat(token, 64)
-	if err != nil {
-		return nil, fmt.Errorf("невалидный номер %s", token)
+	p.get()
+
+	if len(args) < ar.min || (ar.max >= 0 && len(args) > ar.max) {
+		return nil, p.errorAt(nameTok, fmt.Sprintf("неверное число аргументов функции: %d", len(args)))
+	}
+	if len(args) == 1 && ar.max < 0 {
+		return args[0], nil
 	}
 	return &ASTNode{
-		IsLeaf: true,
-		Value:  value,
+		IsLeaf:   false,
+		Operator: name,
+		Args:     args,
 	}, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,300 @@
+package orchestrator
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"calc_service/internal/agent"
+)
+
+func evalAST(t *testing.T, node *ASTNode) float64 {
+	t.Helper()
+	if node.IsLeaf {
+		return node.Value
+	}
+	if len(node.Args) > 0 {
+		acc := evalAST(t, node.Args[0])
+		if len(node.Args) == 1 {
+			return calc(t, node.Operator, acc, 0)
+		}
+		for _, arg := range node.Args[1:] {
+			acc = calc(t, node.Operator, acc, evalAST(t, arg))
+		}
+		return acc
+	}
+	var left, right float64
+	if node.Left != nil {
+		left = evalAST(t, node.Left)
+	}
+	if node.Right != nil {
+		right = evalAST(t, node.Right)
+	}
+	return calc(t, node.Operator, left, right)
+}
+
+func calc(t *testing.T, operation string, a, b float64) float64 {
+	t.Helper()
+	result, err := agent.Calculations(operation, a, b)
+	if err != nil {
+		t.Fatalf("не удалось вычислить %s: %v", operation, err)
+	}
+	return result
+}
+
+func TestParseASTUnary(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		root     string
+	}{
+		{name: "Отрицательное число", expr: "-4", expected: -4},
+		{name: "Двойной минус", expr: "--4", expected: 4},
+		{name: "Унарный плюс", expr: "+4", expected: 4},
+		{name: "Смешанные знаки", expr: "-+-4", expected: 4},
+		{name: "Минус перед скобкой", expr: "-(2+3)", expected: -5, root: "neg"},
+		{name: "Минус после умножения", expr: "2*-(1+1)", expected: -4, root: "*"},
+		{name: "Минус сильнее умножения", expr: "-2*3", expected: -6, root: "*"},
+		{name: "Минус после вычитания", expr: "1 - -1", expected: 2, root: "-"},
+		{name: "Минус перед скобкой в делении", expr: "8/-(2*2)", expected: -2, root: "/"},
+		{name: "Степень сильнее унарного минуса", expr: "-2^2", expected: -4, root: "neg"},
+		{name: "Отрицательное основание в скобках", expr: "(-2)^2", expected: 4, root: "^"},
+		{name: "Отрицательная степень", expr: "2^-1", expected: 0.5, root: "^"},
+		{name: "Минус перед степенью в произведении", expr: "3*-2^2", expected: -12, root: "*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := ParseAST(tt.expr)
+			if err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			if tt.root == "" && !node.IsLeaf {
+				t.Errorf("ожидался лист, имеем оператор %s", node.Operator)
+			}
+			if tt.root != "" && node.Operator != tt.root {
+				t.Errorf("ожидался корень %s, имеем: %s", tt.root, node.Operator)
+			}
+			if result := evalAST(t, node); result != tt.expected {
+				t.Errorf("ожидалось: %v, получено: %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseASTOperators(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		root     string
+	}{
+		{name: "Степень сильнее умножения", expr: "2*3^2", expected: 18, root: "*"},
+		{name: "Правоассоциативная степень", expr: "2^3^2", expected: 512, root: "^"},
+		{name: "Степень в скобках", expr: "(2^3)^2", expected: 64, root: "^"},
+		{name: "Остаток от деления", expr: "7%3", expected: 1, root: "%"},
+		{name: "Остаток наравне с умножением", expr: "2*7%4", expected: 2, root: "%"},
+		{name: "Остаток слабее степени", expr: "10%3^2", expected: 1, root: "%"},
+		{name: "Целочисленное деление", expr: "7//2", expected: 3, root: "//"},
+		{name: "Целочисленное деление левоассоциативно", expr: "20//3//2", expected: 3, root: "//"},
+		{name: "Целочисленное и обычное деление", expr: "9/2//2", expected: 2, root: "//"},
+		{name: "Целочисленное деление сильнее сложения", expr: "1+7//2", expected: 4, root: "+"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := ParseAST(tt.expr)
+			if err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			if node.Operator != tt.root {
+				t.Errorf("ожидался корень %s, имеем: %s", tt.root, node.Operator)
+			}
+			if result := evalAST(t, node); result != tt.expected {
+				t.Errorf("ожидалось: %v, получено: %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseASTFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		expected float64
+		root     string
+		args     int
+	}{
+		{name: "Корень", expr: "sqrt(16)", expected: 4, root: "sqrt", args: 1},
+		{name: "Корень и максимум", expr: "sqrt(4)*max(3, 4)", expected: 8, root: "*"},
+		{name: "Минимум нескольких аргументов", expr: "min(5, 2, 8, 3)", expected: 2, root: "min", args: 4},
+		{name: "Максимум одного аргумента", expr: "max(7)", expected: 7},
+		{name: "Вложенные вызовы", expr: "abs(min(-3, round(2.6)))", expected: 3, root: "abs", args: 1},
+		{name: "Выражение в аргументе", expr: "max(1+2, 2*2)", expected: 4, root: "max", args: 2},
+		{name: "Унарный минус перед функцией", expr: "-abs(-2)^2", expected: -4, root: "neg"},
+		{name: "Синус и косинус", expr: "sin(0)+cos(0)", expected: 1, root: "+"},
+		{name: "Логарифм", expr: "log(1)", expected: 0, root: "log", args: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := ParseAST(tt.expr)
+			if err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			if node.Operator != tt.root {
+				t.Errorf("ожидался корень %s, имеем: %s", tt.root, node.Operator)
+			}
+			if len(node.Args) != tt.args {
+				t.Errorf("ожидалось аргументов: %d, имеем: %d", tt.args, len(node.Args))
+			}
+			if result := evalAST(t, node); result != tt.expected {
+				t.Errorf("ожидалось: %v, получено: %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestBindVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		vars     map[string]float64
+		expected float64
+	}{
+		{name: "Линейная функция", expr: "a*x+b", vars: map[string]float64{"a": 2, "x": 3, "b": 1}, expected: 7},
+		{name: "Константа pi", expr: "2*pi", expected: 2 * math.Pi},
+		{name: "Константа e", expr: "log(e)", expected: 1},
+		{name: "Переменная важнее константы", expr: "e+1", vars: map[string]float64{"e": 1}, expected: 2},
+		{name: "Минус перед переменной", expr: "-x", vars: map[string]float64{"x": 5}, expected: -5},
+		{name: "Переменная в функции", expr: "max(x_1, x_2)", vars: map[string]float64{"x_1": 1, "x_2": 2}, expected: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := ParseAST(tt.expr)
+			if err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			if err := BindVariables(node, tt.vars); err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			if result := evalAST(t, node); result != tt.expected {
+				t.Errorf("ожидалось: %v, получено: %v", tt.expected, result)
+			}
+		})
+	}
+
+	t.Run("Незаданные переменные", func(t *testing.T) {
+		node, err := ParseAST("a*x+b*x+c")
+		if err != nil {
+			t.Fatalf("неожиданная ошибка: %v", err)
+		}
+		err = BindVariables(node, map[string]float64{"b": 1})
+
+		var unbound *UnboundVariablesError
+		if !errors.As(err, &unbound) {
+			t.Fatalf("ожидалась UnboundVariablesError, получено: %v", err)
+		}
+		if expected := []string{"a", "x", "c"}; !reflect.DeepEqual(unbound.Names, expected) {
+			t.Errorf("ожидалось: %v, получено: %v", expected, unbound.Names)
+		}
+	})
+}
+
+func TestParseASTErrors(t *testing.T) {
+	for _, expr := range []string{"", "2+*2", "-", "2*-", "(2+3", "2+3)", "2^", "2///2", "%2",
+		"foo(1)", "sqrt", "sqrt()", "sqrt(1, 2)", "max()", "max(1,)", "min(1, 2"} {
+		if _, err := ParseAST(expr); err == nil {
+			t.Errorf("ожидалась ошибка для %q", expr)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		offset   int
+		line     int
+		column   int
+		token    string
+		snippet  string
+		expected string
+	}{
+		{
+			name: "Пропущенный операнд", expr: "2 + * 2",
+			offset: 4, line: 1, column: 5, token: "*",
+			snippet: "2 + * 2\n    ^", expected: "число",
+		},
+		{
+			name: "Лишний токен после пробелов", expr: "  2 3",
+			offset: 4, line: 1, column: 5, token: "3",
+			snippet: "  2 3\n    ^", expected: endOfInput,
+		},
+		{
+			name: "Нет закрывающей скобки", expr: "(1 + 2",
+			offset: 6, line: 1, column: 7, token: "",
+			snippet: "(1 + 2\n      ^", expected: ")",
+		},
+		{
+			name: "Неизвестная функция", expr: "1 + foo(2)",
+			offset: 4, line: 1, column: 5, token: "foo",
+			snippet: "1 + foo(2)\n    ^~~",
+		},
+		{
+			name: "Ошибка на второй строке", expr: "1 +\n 2 3",
+			offset: 7, line: 2, column: 4, token: "3",
+			snippet: " 2 3\n   ^", expected: "*",
+		},
+		{
+			name: "Неизвестный символ", expr: "2 $ 3",
+			offset: 2, line: 1, column: 3, token: "$",
+			snippet: "2 $ 3\n  ^",
+		},
+		{
+			name: "Позиция после кириллицы", expr: "ж + 1)",
+			offset: 6, line: 1, column: 6, token: ")",
+			snippet: "ж + 1)\n     ^", expected: "+",
+		},
+		{
+			name: "Невалидное число", expr: "1.2.3",
+			offset: 0, line: 1, column: 1, token: "1.2.3",
+			snippet: "1.2.3\n^~~~~", expected: "число",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseAST(tt.expr)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("ожидалась ParseError, получено: %v", err)
+			}
+			if parseErr.Offset != tt.offset || parseErr.Line != tt.line || parseErr.Column != tt.column {
+				t.Errorf("ожидалось смещение %d (%d:%d), получено %d (%d:%d)",
+					tt.offset, tt.line, tt.column, parseErr.Offset, parseErr.Line, parseErr.Column)
+			}
+			if parseErr.Token != tt.token {
+				t.Errorf("ожидался токен %q, получен %q", tt.token, parseErr.Token)
+			}
+			if parseErr.Snippet != tt.snippet {
+				t.Errorf("ожидался фрагмент:\n%s\nполучен:\n%s", tt.snippet, parseErr.Snippet)
+			}
+			if tt.expected != "" && !contains(parseErr.Expected, tt.expected) {
+				t.Errorf("ожидаемые токены %v не содержат %q", parseErr.Expected, tt.expected)
+			}
+		})
+	}
+}
+
+func contains(items []string, item string) bool {
+	for _, it := range items {
+		if it == item {
+			return true
+		}
+	}
+	return false
+}
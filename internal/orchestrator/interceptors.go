@@ -0,0 +1,172 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"calc_service/internal/proto"
+)
+
+// Интерсепторы применяются только к методам Calculator: health и reflection
+// не требуют токена агента и не попадают в журнал и метрики.
+func isCalculatorMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+proto.Calculator_ServiceDesc.ServiceName+"/")
+}
+
+func calculatorUnary(i grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !isCalculatorMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		return i(ctx, req, info, handler)
+	}
+}
+
+func calculatorStream(i grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !isCalculatorMethod(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		return i(srv, ss, info, handler)
+	}
+}
+
+// observe записывает вызов в журнал и метрики.
+func (o *Orchestrator) observe(method string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	o.grpcMetrics.record(method, elapsed, err)
+	log.Printf("gRPC %s: %s за %v", method, status.Code(err), elapsed)
+}
+
+func (o *Orchestrator) observeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	o.observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+func (o *Orchestrator) observeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	o.observe(info.FullMethod, start, err)
+	return err
+}
+
+// recoverUnary превращает панику обработчика в ошибку Internal, чтобы она
+// не роняла весь оркестратор.
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Паника в %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Паника в %s: %v\n%s", info.FullMethod, r, debug.Stack())
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// MethodStats — задержки вызовов одного метода gRPC.
+type MethodStats struct {
+	Calls  int64   `json:"calls"`
+	Errors int64   `json:"errors"`
+	AvgMs  float64 `json:"avg_ms"`
+	MaxMs  float64 `json:"max_ms"`
+	total  time.Duration
+	max    time.Duration
+}
+
+// methodMetrics накапливает MethodStats по методам. Нулевое значение готово к использованию.
+type methodMetrics struct {
+	mu      sync.Mutex
+	methods map[string]*MethodStats
+}
+
+func (m *methodMetrics) record(method string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.methods == nil {
+		m.methods = make(map[string]*MethodStats)
+	}
+	st, ok := m.methods[method]
+	if !ok {
+		st = &MethodStats{}
+		m.methods[method] = st
+	}
+	st.Calls++
+	if err != nil {
+		st.Errors++
+	}
+	st.total += elapsed
+	st.max = max(st.max, elapsed)
+}
+
+func (m *methodMetrics) snapshot() map[string]MethodStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string]MethodStats, len(m.methods))
+	for method, st := range m.methods {
+		stats[method] = MethodStats{
+			Calls:  st.Calls,
+			Errors: st.Errors,
+			AvgMs:  float64(st.total.Microseconds()) / float64(st.Calls) / 1000,
+			MaxMs:  float64(st.max.Microseconds()) / 1000,
+		}
+	}
+	return stats
+}
+
+func (o *Orchestrator) grpcMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Неверный метод"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"methods": o.grpcMetrics.snapshot()})
+}
+
+// healthCheckInterval — как часто обновляется статус grpc.health.v1.
+const healthCheckInterval = 5 * time.Second
+
+// watchHealth периодически сообщает через grpc.health.v1, готов ли оркестратор:
+// база доступна и её схема обновлена.
+func (o *Orchestrator) watchHealth(hs *health.Server, interval time.Duration) {
+	for {
+		o.updateHealth(hs)
+		time.Sleep(interval)
+	}
+}
+
+func (o *Orchestrator) updateHealth(hs *health.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	st := healthpb.HealthCheckResponse_SERVING
+	if err := o.Storage.Ready(ctx); err != nil {
+		log.Printf("Оркестратор не готов: %v", err)
+		st = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	hs.SetServingStatus("", st)
+	hs.SetServingStatus(proto.Calculator_ServiceDesc.ServiceName, st)
+}
@@ -0,0 +1,228 @@
+package orchestrator
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+// token — лексема выражения. Start и End задают байтовый диапазон в исходной строке.
+type token struct {
+	Kind       tokenKind
+	Text       string
+	Value      float64
+	Start, End int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.Kind == kind && t.Text == text
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+func tokenize(input string) ([]token, error) {
+	l := &lexer{input: input}
+	var tokens []token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.Kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) peekRune(offset int) rune {
+	if offset >= len(l.input) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[offset:])
+	return r
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += size
+	}
+
+	start := l.pos
+	if start >= len(l.input) {
+		return token{Kind: tokenEOF, Start: start, End: start}, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(l.input[start:])
+	switch {
+	case isDecimalDigit(r) || (r == '.' && isDecimalDigit(l.peekRune(start+1))):
+		return l.number()
+	case unicode.IsLetter(r) || r == '_':
+		end := l.wordEnd(start)
+		l.pos = end
+		return token{Kind: tokenIdent, Text: l.input[start:end], Start: start, End: end}, nil
+	case strings.HasPrefix(l.input[start:], "//"):
+		l.pos += 2
+		return token{Kind: tokenOperator, Text: "//", Start: start, End: l.pos}, nil
+	case strings.ContainsRune("+-*/%^", r):
+		l.pos += size
+		return token{Kind: tokenOperator, Text: string(r), Start: start, End: l.pos}, nil
+	case r == '(':
+		l.pos += size
+		return token{Kind: tokenLParen, Text: "(", Start: start, End: l.pos}, nil
+	case r == ')':
+		l.pos += size
+		return token{Kind: tokenRParen, Text: ")", Start: start, End: l.pos}, nil
+	case r == ',':
+		l.pos += size
+		return token{Kind: tokenComma, Text: ",", Start: start, End: l.pos}, nil
+	}
+	return token{}, newParseError(l.input, start, string(r), "неизвестный символ")
+}
+
+func (l *lexer) wordEnd(start int) int {
+	end := start
+	for end < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[end:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			break
+		}
+		end += size
+	}
+	return end
+}
+
+// number разбирает десятичные литералы с дробной частью и экспонентой,
+// шестнадцатеричные (0x1F) и двоичные (0b101) литералы. Подчёркивание
+// допускается только между цифрами: 1_000_000.
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	base := 10
+	if l.input[start] == '0' && start+1 < len(l.input) {
+		switch l.input[start+1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		}
+	}
+
+	var end int
+	var valid bool
+	if base != 10 {
+		end, valid = l.digits(start+2, base)
+	} else {
+		end, valid = l.decimal(start)
+	}
+
+	// Буквы, цифры, точки и подчёркивания, прилипшие к числу, делают его невалидным: 1.2.3, 0x1G, 2x.
+	for end < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[end:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' {
+			break
+		}
+		valid = false
+		end += size
+	}
+
+	text := l.input[start:end]
+	l.pos = end
+	if !valid {
+		return token{}, newParseError(l.input, start, text, "невалидное число", "число")
+	}
+
+	value, err := parseNumber(text, base)
+	if err != nil {
+		return token{}, newParseError(l.input, start, text, "невалидное число", "число")
+	}
+	return token{Kind: tokenNumber, Text: text, Value: value, Start: start, End: end}, nil
+}
+
+func (l *lexer) decimal(pos int) (int, bool) {
+	end, ok := l.digits(pos, 10)
+	valid := ok || end == pos
+	if end < len(l.input) && l.input[end] == '.' {
+		end++
+		if isDecimalDigit(l.peekRune(end)) {
+			end, ok = l.digits(end, 10)
+			valid = valid && ok
+		}
+	}
+	if end < len(l.input) && (l.input[end] == 'e' || l.input[end] == 'E') {
+		end++
+		if end < len(l.input) && (l.input[end] == '+' || l.input[end] == '-') {
+			end++
+		}
+		end, ok = l.digits(end, 10)
+		valid = valid && ok
+	}
+	return end, valid
+}
+
+// digits пропускает непустую последовательность цифр системы base,
+// разделённых одиночными подчёркиваниями.
+func (l *lexer) digits(pos, base int) (int, bool) {
+	start := pos
+	for pos < len(l.input) {
+		c := l.input[pos]
+		if c == '_' {
+			if pos == start || pos+1 >= len(l.input) || !isDigitOf(l.input[pos+1], base) {
+				return pos, false
+			}
+			pos++
+			continue
+		}
+		if !isDigitOf(c, base) {
+			break
+		}
+		pos++
+	}
+	return pos, pos > start
+}
+
+func isDigitOf(c byte, base int) bool {
+	switch base {
+	case 2:
+		return c == '0' || c == '1'
+	case 16:
+		return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+	default:
+		return c >= '0' && c <= '9'
+	}
+}
+
+func isDecimalDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func parseNumber(text string, base int) (float64, error) {
+	text = strings.ReplaceAll(text, "_", "")
+	if base == 10 {
+		return strconv.ParseFloat(text, 64)
+	}
+	n, err := strconv.ParseUint(text[2:], base, 64)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n), nil
+}
@@ -0,0 +1,108 @@
+package orchestrator
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTokenizeNumbers(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected float64
+	}{
+		{name: "Целое число", input: "42", expected: 42},
+		{name: "Десятичная дробь", input: "3.25", expected: 3.25},
+		{name: "Дробь без целой части", input: ".5", expected: 0.5},
+		{name: "Экспонента", input: "1e3", expected: 1000},
+		{name: "Отрицательная экспонента", input: "1e-3", expected: 0.001},
+		{name: "Экспонента со знаком плюс", input: "2.5E+2", expected: 250},
+		{name: "Шестнадцатеричное число", input: "0x1F", expected: 31},
+		{name: "Шестнадцатеричное с разделителем", input: "0xFF_FF", expected: 65535},
+		{name: "Двоичное число", input: "0b101", expected: 5},
+		{name: "Разделители разрядов", input: "1_000_000", expected: 1000000},
+		{name: "Разделители в дробной части", input: "1_000.000_5", expected: 1000.0005},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := tokenize(tt.input)
+			if err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			if len(tokens) != 2 || tokens[0].Kind != tokenNumber || tokens[1].Kind != tokenEOF {
+				t.Fatalf("ожидалось одно число, получено: %+v", tokens)
+			}
+			if tokens[0].Value != tt.expected {
+				t.Errorf("ожидалось: %v, получено: %v", tt.expected, tokens[0].Value)
+			}
+			if tokens[0].Start != 0 || tokens[0].End != len(tt.input) {
+				t.Errorf("неверный диапазон токена: [%d, %d)", tokens[0].Start, tokens[0].End)
+			}
+		})
+	}
+}
+
+func TestTokenizeMalformedNumbers(t *testing.T) {
+	tests := []struct {
+		input  string
+		offset int
+		token  string
+	}{
+		{input: "1.2.3", offset: 0, token: "1.2.3"},
+		{input: "2 + 1e", offset: 4, token: "1e"},
+		{input: "1e+", offset: 0, token: "1e+"},
+		{input: "0x", offset: 0, token: "0x"},
+		{input: "0x1G", offset: 0, token: "0x1G"},
+		{input: "0b102", offset: 0, token: "0b102"},
+		{input: "1__000", offset: 0, token: "1__000"},
+		{input: "1_000_", offset: 0, token: "1_000_"},
+		{input: "3 * 2x", offset: 4, token: "2x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParseAST(tt.input)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("ожидалась ParseError, получено: %v", err)
+			}
+			if parseErr.Offset != tt.offset || parseErr.Token != tt.token {
+				t.Errorf("ожидался токен %q на месте %d, получен %q на месте %d",
+					tt.token, tt.offset, parseErr.Token, parseErr.Offset)
+			}
+		})
+	}
+}
+
+func TestTokenizeSpans(t *testing.T) {
+	tokens, err := tokenize(" max(x, 0x10) // 2")
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+
+	expected := []struct {
+		kind       tokenKind
+		text       string
+		start, end int
+	}{
+		{tokenIdent, "max", 1, 4},
+		{tokenLParen, "(", 4, 5},
+		{tokenIdent, "x", 5, 6},
+		{tokenComma, ",", 6, 7},
+		{tokenNumber, "0x10", 8, 12},
+		{tokenRParen, ")", 12, 13},
+		{tokenOperator, "//", 14, 16},
+		{tokenNumber, "2", 17, 18},
+		{tokenEOF, "", 18, 18},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("ожидалось токенов: %d, получено: %+v", len(expected), tokens)
+	}
+	for i, e := range expected {
+		tok := tokens[i]
+		if tok.Kind != e.kind || tok.Text != e.text || tok.Start != e.start || tok.End != e.end {
+			t.Errorf("токен %d: ожидался %+v, получен %+v", i, e, tok)
+		}
+	}
+}
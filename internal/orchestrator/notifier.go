@@ -0,0 +1,28 @@
+package orchestrator
+
+import "sync"
+
+// notifier будит всех ожидающих разом: wait возвращает канал, который закроется
+// при следующем вызове notify. Нулевое значение готово к использованию.
+type notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
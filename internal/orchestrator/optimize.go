@@ -0,0 +1,160 @@
+package orchestrator
+
+import (
+	"math"
+
+	"calc_service/internal/agent"
+)
+
+// Optimize сворачивает константные поддеревья и применяет тождества
+// (x*1, x+0, x*0 и т.п.) до планирования задач. Возвращает новый корень
+// и число задач, которые не придётся отправлять агентам.
+func Optimize(node *ASTNode) (*ASTNode, int) {
+	before := countTasks(node)
+	node = optimize(node)
+	return node, before - countTasks(node)
+}
+
+func optimize(node *ASTNode) *ASTNode {
+	if node == nil || node.IsLeaf {
+		return node
+	}
+
+	node.Left = optimize(node.Left)
+	node.Right = optimize(node.Right)
+	for i, arg := range node.Args {
+		node.Args[i] = optimize(arg)
+	}
+
+	if value, ok := fold(node); ok {
+		return &ASTNode{
+			IsLeaf: true,
+			Value:  value,
+		}
+	}
+	return simplify(node)
+}
+
+// fold вычисляет узел локально, если все его операнды — числа. Узлы, вычисление
+// которых завершается ошибкой, остаются агентам, чтобы ошибка дошла до выражения.
+func fold(node *ASTNode) (float64, bool) {
+	var result float64
+	var err error
+
+	if len(node.Args) > 0 {
+		for _, arg := range node.Args {
+			if !arg.IsLeaf {
+				return 0, false
+			}
+		}
+		result = node.Args[0].Value
+		if len(node.Args) == 1 {
+			result, err = agent.Calculations(node.Operator, result, 0)
+		}
+		for _, arg := range node.Args[1:] {
+			if err != nil {
+				break
+			}
+			result, err = agent.Calculations(node.Operator, result, arg.Value)
+		}
+	} else {
+		if !node.Left.IsLeaf || (node.Right != nil && !node.Right.IsLeaf) {
+			return 0, false
+		}
+		var right float64
+		if node.Right != nil {
+			right = node.Right.Value
+		}
+		result, err = agent.Calculations(node.Operator, node.Left.Value, right)
+	}
+
+	if err != nil || math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, false
+	}
+	return result, true
+}
+
+func simplify(node *ASTNode) *ASTNode {
+	left, right := node.Left, node.Right
+	switch node.Operator {
+	case "+":
+		if isConst(right, 0) {
+			return left
+		}
+		if isConst(left, 0) {
+			return right
+		}
+	case "-":
+		if isConst(right, 0) {
+			return left
+		}
+	case "*":
+		if isConst(right, 1) {
+			return left
+		}
+		if isConst(left, 1) {
+			return right
+		}
+		if (isConst(right, 0) && !canFail(left)) || (isConst(left, 0) && !canFail(right)) {
+			return &ASTNode{IsLeaf: true, Value: 0}
+		}
+	case "/":
+		if isConst(right, 1) {
+			return left
+		}
+	case "^":
+		if isConst(right, 1) {
+			return left
+		}
+		if isConst(right, 0) && !canFail(left) {
+			return &ASTNode{IsLeaf: true, Value: 1}
+		}
+	case "neg":
+		if left.Operator == "neg" && len(left.Args) == 0 {
+			return left.Left
+		}
+	}
+	return node
+}
+
+func isConst(node *ASTNode, value float64) bool {
+	return node != nil && node.IsLeaf && node.Value == value
+}
+
+// canFail сообщает, может ли вычисление поддерева завершиться ошибкой.
+// Такие поддеревья нельзя отбрасывать тождествами вроде x*0. Сложение, вычитание
+// и умножение могут переполниться до ±Inf, а Inf*0 даёт NaN.
+func canFail(node *ASTNode) bool {
+	if node == nil || node.IsLeaf {
+		return false
+	}
+	switch node.Operator {
+	case "+", "-", "*", "/", "//", "%", "^", "sqrt", "log":
+		return true
+	}
+	if canFail(node.Left) || canFail(node.Right) {
+		return true
+	}
+	for _, arg := range node.Args {
+		if canFail(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// countTasks повторяет правила Orchestrator.Tasks: n-арная функция
+// раскладывается в цепочку из n-1 бинарных задач.
+func countTasks(node *ASTNode) int {
+	if node == nil || node.IsLeaf {
+		return 0
+	}
+	count := countTasks(node.Left) + countTasks(node.Right)
+	for _, arg := range node.Args {
+		count += countTasks(arg)
+	}
+	if len(node.Args) > 1 {
+		return count + len(node.Args) - 1
+	}
+	return count + 1
+}
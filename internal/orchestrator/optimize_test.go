@@ -0,0 +1,51 @@
+package orchestrator
+
+import "testing"
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		vars     map[string]float64
+		saved    int
+		tasks    int
+		expected float64
+	}{
+		{name: "Константное выражение", expr: "2+2*2", saved: 2, tasks: 0, expected: 6},
+		{name: "Функции от констант", expr: "sqrt(16)*max(1, 2, 3)", saved: 4, tasks: 0, expected: 12},
+		{name: "Переменные считаются константами", expr: "a*x+b", vars: map[string]float64{"a": 2, "x": 3, "b": 1}, saved: 2, tasks: 0, expected: 7},
+		{name: "Деление на нуль остаётся агентам", expr: "1/0", saved: 0, tasks: 1},
+		{name: "Сворачивается всё, кроме ошибки", expr: "(1/0)+2*3", saved: 1, tasks: 2},
+		{name: "Умножение на единицу", expr: "(1/0)*1", saved: 1, tasks: 1},
+		{name: "Сложение с нулём", expr: "0+(1/0)-0", saved: 2, tasks: 1},
+		{name: "Умножение на нуль", expr: "(sin(1)+cos(1)*2)*0", saved: 5, tasks: 0, expected: 0},
+		{name: "Умножение на нуль не скрывает ошибку", expr: "(1/0)*0", saved: 0, tasks: 2},
+		{name: "Умножение на нуль не скрывает переполнение", expr: "(1e308*10)*0", saved: 0, tasks: 2},
+		{name: "Нулевая степень не скрывает переполнение", expr: "(1e308+1e308)^0", saved: 0, tasks: 2},
+		{name: "Первая степень", expr: "(1/0)^1", saved: 1, tasks: 1},
+		{name: "Двойное отрицание", expr: "--(1/0)", saved: 2, tasks: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := ParseAST(tt.expr)
+			if err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+			if err := BindVariables(node, tt.vars); err != nil {
+				t.Fatalf("неожиданная ошибка: %v", err)
+			}
+
+			node, saved := Optimize(node)
+			if saved != tt.saved {
+				t.Errorf("ожидалось сэкономленных задач: %d, получено: %d", tt.saved, saved)
+			}
+			if tasks := countTasks(node); tasks != tt.tasks {
+				t.Errorf("ожидалось оставшихся задач: %d, получено: %d", tt.tasks, tasks)
+			}
+			if tt.tasks == 0 && (!node.IsLeaf || node.Value != tt.expected) {
+				t.Errorf("ожидался лист %v, получено: %+v", tt.expected, node)
+			}
+		})
+	}
+}
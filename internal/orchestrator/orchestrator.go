@@ -15,7 +15,12 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
 
+	"calc_service/internal/agent"
 	"calc_service/internal/auth"
 	"calc_service/internal/proto"
 	"calc_service/internal/storage"
@@ -33,24 +38,68 @@ type Config struct {
 	TimeSubtraction     int
 	TimeMultiplications int
 	TimeDivisions       int
+	TimePower           int
+	TimeModulo          int
+	TimeIntDivisions    int
+	TimeNegation        int
+	TimeFunctions       map[string]int
+	LeaseSlack          time.Duration
+	MaxAttempts         int
+	RetryBackoff        time.Duration
+	AdminLogins         map[string]bool
+	ExpressionTimeout   time.Duration
+	MaxBatchSize        int
+	HeartbeatInterval   time.Duration
+	AgentTimeout        time.Duration
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSClientCAFile     string
+	AgentTokens         map[string]string
+	InternalHTTPAddr    string
+	GRPCReflection      bool
 }
 
 type Orchestrator struct {
-	Config      *Config
-	exprStore   map[string]*Expression
-	taskStore   map[string]*Task
-	taskQueue   []*Task
-	mu          sync.Mutex
-	taskCounter int64
-	Storage     *storage.Storage
+	Config    *Config
+	exprStore map[string]*Expression
+	taskStore map[string]*Task
+	taskQueue []*Task
+	mu        sync.Mutex
+	Storage   *storage.Storage
+
+	// tasksChanged срабатывает, когда могли появиться готовые задачи
+	// или освободиться воркеры агентов, подключённых через StreamTasks.
+	tasksChanged notifier
+	agents       agentRegistry
+	grpcMetrics  methodMetrics
 }
 
 type Expression struct {
-	ID     string   `json:"id"`
-	Expr   string   `json:"expression"`
-	Status string   `json:"status"`
-	Result *float64 `json:"result,omitempty"`
-	AST    *ASTNode `json:"-"`
+	ID         string      `json:"id"`
+	UserID     int         `json:"-"`
+	Expr       string      `json:"expression"`
+	Status     string      `json:"status"`
+	Result     *float64    `json:"result,omitempty"`
+	Reason     string      `json:"error_reason,omitempty"`
+	Priority   string      `json:"priority,omitempty"`
+	Deadline   *time.Time  `json:"deadline,omitempty"`
+	TasksSaved int         `json:"tasks_saved,omitempty"`
+	Plan       []*PlanTask `json:"plan,omitempty"`
+	AST        *ASTNode    `json:"-"`
+}
+
+// PlanTask — задача выражения в том виде, в каком её видит клиент: с зависимостями
+// и списком задач, которые используют её результат.
+type PlanTask struct {
+	ID         string   `json:"id"`
+	Operation  string   `json:"operation"`
+	Arg1       float64  `json:"arg1"`
+	Arg2       float64  `json:"arg2"`
+	Arg1TaskID string   `json:"arg1_task_id,omitempty"`
+	Arg2TaskID string   `json:"arg2_task_id,omitempty"`
+	Consumers  []string `json:"consumers,omitempty"`
+	Status     string   `json:"status"`
+	Result     *float64 `json:"result,omitempty"`
 }
 
 type Task struct {
@@ -94,6 +143,77 @@ func Configuration() *Config {
 		td = 100
 	}
 
+	tp, _ := strconv.Atoi(os.Getenv("TIME_POWER_MS"))
+	if tp == 0 {
+		tp = 100
+	}
+
+	tmod, _ := strconv.Atoi(os.Getenv("TIME_MODULO_MS"))
+	if tmod == 0 {
+		tmod = 100
+	}
+
+	tid, _ := strconv.Atoi(os.Getenv("TIME_INT_DIVISIONS_MS"))
+	if tid == 0 {
+		tid = 100
+	}
+
+	tn, _ := strconv.Atoi(os.Getenv("TIME_NEGATION_MS"))
+	if tn == 0 {
+		tn = 100
+	}
+
+	ls, err := strconv.Atoi(os.Getenv("TASK_LEASE_SLACK_MS"))
+	if err != nil || ls < 0 {
+		ls = int(storage.DefaultLeaseSlack.Milliseconds())
+	}
+
+	ma, _ := strconv.Atoi(os.Getenv("TASK_MAX_ATTEMPTS"))
+	if ma < 1 {
+		ma = storage.DefaultMaxAttempts
+	}
+
+	rb, err := strconv.Atoi(os.Getenv("TASK_RETRY_BACKOFF_MS"))
+	if err != nil || rb < 0 {
+		rb = int(storage.DefaultRetryBackoff.Milliseconds())
+	}
+
+	et, err := strconv.Atoi(os.Getenv("EXPRESSION_TIMEOUT_MS"))
+	if err != nil || et < 0 {
+		et = 0
+	}
+
+	mb, _ := strconv.Atoi(os.Getenv("TASK_BATCH_MAX"))
+	if mb < 1 {
+		mb = 64
+	}
+
+	hb, _ := strconv.Atoi(os.Getenv("AGENT_HEARTBEAT_MS"))
+	if hb < 1 {
+		hb = 5000
+	}
+
+	at, _ := strconv.Atoi(os.Getenv("AGENT_TIMEOUT_MS"))
+	if at < 1 {
+		at = 3 * hb
+	}
+
+	admins := make(map[string]bool)
+	for _, login := range strings.Split(os.Getenv("ADMIN_LOGINS"), ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			admins[login] = true
+		}
+	}
+
+	tf := make(map[string]int, len(functions))
+	for name := range functions {
+		t, _ := strconv.Atoi(os.Getenv("TIME_" + strings.ToUpper(name) + "_MS"))
+		if t == 0 {
+			t = 100
+		}
+		tf[name] = t
+	}
+
 	return &Config{
 		HTTPAddr:            httpPort,
 		GRPCAddr:            grpcPort,
@@ -101,27 +221,165 @@ func Configuration() *Config {
 		TimeSubtraction:     ts,
 		TimeMultiplications: tm,
 		TimeDivisions:       td,
+		TimePower:           tp,
+		TimeModulo:          tmod,
+		TimeIntDivisions:    tid,
+		TimeNegation:        tn,
+		TimeFunctions:       tf,
+		LeaseSlack:          time.Duration(ls) * time.Millisecond,
+		MaxAttempts:         ma,
+		RetryBackoff:        time.Duration(rb) * time.Millisecond,
+		AdminLogins:         admins,
+		ExpressionTimeout:   time.Duration(et) * time.Millisecond,
+		MaxBatchSize:        mb,
+		HeartbeatInterval:   time.Duration(hb) * time.Millisecond,
+		AgentTimeout:        time.Duration(at) * time.Millisecond,
+		TLSCertFile:         os.Getenv("GRPC_TLS_CERT"),
+		TLSKeyFile:          os.Getenv("GRPC_TLS_KEY"),
+		TLSClientCAFile:     os.Getenv("GRPC_TLS_CLIENT_CA"),
+		AgentTokens:         parseAgentTokens(os.Getenv("AGENT_TOKENS")),
+		InternalHTTPAddr:    os.Getenv("INTERNAL_HTTP_ADDR"),
+		GRPCReflection:      os.Getenv("GRPC_REFLECTION") == "true",
 	}
 }
 
 func (s *server) GetTask(ctx context.Context, req *proto.TaskRequest) (*proto.TaskResponse, error) {
-	task, err := s.o.Storage.GetPendingTask()
+	owner, err := leaseOwner(ctx, req)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	tasks, err := s.o.Storage.GetPendingTasks(owner, 1, s.o.agents.capabilities(owner, req.Operations))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if len(tasks) == 0 {
+		return nil, statusError(storage.ErrNotFound)
+	}
+	return taskResponse(tasks[0]), nil
+}
+
+// GetTasks выдаёт агенту столько задач, сколько у него свободных воркеров,
+// но не больше MaxBatchSize.
+func (s *server) GetTasks(ctx context.Context, req *proto.TaskRequest) (*proto.TaskBatch, error) {
+	limit := min(max(int(req.ComputingPower), 1), s.o.Config.MaxBatchSize)
+
+	owner, err := leaseOwner(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, statusError(err)
+	}
+	tasks, err := s.o.Storage.GetPendingTasks(owner, limit, s.o.agents.capabilities(owner, req.Operations))
+	if err != nil {
+		return nil, statusError(err)
 	}
 
+	batch := &proto.TaskBatch{Tasks: make([]*proto.TaskResponse, 0, len(tasks))}
+	for _, task := range tasks {
+		batch.Tasks = append(batch.Tasks, taskResponse(task))
+	}
+	return batch, nil
+}
+
+func (s *server) SubmitResults(ctx context.Context, req *proto.ResultBatch) (*proto.ResultBatchResponse, error) {
+	owner, err := agentIdentity(ctx, "")
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	resp := &proto.ResultBatchResponse{}
+	for _, r := range req.Results {
+		if err := s.o.submitResult(owner, r.Id, r.Result, r.ErrorCode, r.ErrorMessage); err != nil {
+			log.Printf("Не удалось принять результат задачи %s: %v", r.Id, err)
+			if storage.IsBusy(err) {
+				resp.RetryIds = append(resp.RetryIds, r.Id)
+			} else {
+				resp.FailedIds = append(resp.FailedIds, r.Id)
+			}
+			continue
+		}
+		resp.Accepted++
+	}
+	return resp, nil
+}
+
+// streamPollInterval — как часто StreamTasks перепроверяет очередь без уведомлений:
+// аренды и задержки перед повтором истекают по времени, а не по событию.
+const streamPollInterval = time.Second
+
+// StreamTasks отправляет агенту готовые задачи, пока число его арендованных задач
+// меньше computing_power. Освободившиеся воркеры определяются по принятым результатам.
+func (s *server) StreamTasks(req *proto.TaskRequest, stream grpc.ServerStreamingServer[proto.TaskResponse]) error {
+	ctx := stream.Context()
+	owner, err := leaseOwner(ctx, req)
+	if err != nil {
+		return err
+	}
+	capacity := max(int(req.ComputingPower), 1)
+	log.Printf("Агент %s подключился к потоку задач (воркеров: %d)", owner, capacity)
+
+	for {
+		changed := s.o.tasksChanged.wait()
+
+		leased, err := s.o.Storage.CountLeasedTasks(owner)
+		if err != nil {
+			return statusError(err)
+		}
+
+		var tasks []*storage.Task
+		if free := capacity - leased; free > 0 {
+			tasks, err = s.o.Storage.GetPendingTasks(owner, min(free, s.o.Config.MaxBatchSize), s.o.agents.capabilities(owner, req.Operations))
+			if err != nil {
+				return statusError(err)
+			}
+		}
+		for _, task := range tasks {
+			if err := stream.Send(taskResponse(task)); err != nil {
+				return err
+			}
+		}
+		if len(tasks) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Агент %s отключился от потока задач", owner)
+			return nil
+		case <-changed:
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+// leaseOwner — имя агента для аренды задач; старые агенты его не передают,
+// тогда используется адрес соединения.
+func leaseOwner(ctx context.Context, req *proto.TaskRequest) (string, error) {
+	id, err := agentIdentity(ctx, req.AgentId)
+	if err != nil || id != "" {
+		return id, err
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String(), nil
+	}
+	return "", nil
+}
+
+func taskResponse(task *storage.Task) *proto.TaskResponse {
 	return &proto.TaskResponse{
 		Id:            task.ID,
 		Arg1:          task.Arg1,
 		Arg2:          task.Arg2,
 		Operation:     task.Operation,
 		OperationTime: int32(task.OperationTime),
-	}, nil
+	}
 }
 
 func (s *server) SubmitResult(ctx context.Context, req *proto.ResultRequest) (*proto.ResultResponse, error) {
-	if err := s.o.Storage.CompleteTask(req.Id, req.Result); err != nil {
-		return nil, err
+	owner, err := agentIdentity(ctx, "")
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if err := s.o.submitResult(owner, req.Id, req.Result, req.ErrorCode, req.ErrorMessage); err != nil {
+		return nil, statusError(err)
 	}
 	return &proto.ResultResponse{Success: true}, nil
 }
@@ -137,8 +395,13 @@ func NewOrchestrator() *Orchestrator {
 		log.Fatal(err)
 	}
 
+	config := Configuration()
+	storage.LeaseSlack = config.LeaseSlack
+	storage.MaxAttempts = config.MaxAttempts
+	storage.RetryBackoff = config.RetryBackoff
+
 	return &Orchestrator{
-		Config:    Configuration(),
+		Config:    config,
 		Storage:   storage,
 		exprStore: make(map[string]*Expression),
 		taskStore: make(map[string]*Task),
@@ -155,21 +418,62 @@ func (o *Orchestrator) calculateHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	var req struct {
-		Expression string `json:"expression"`
+		Expression string             `json:"expression"`
+		Variables  map[string]float64 `json:"variables"`
+		Optimize   bool               `json:"optimize"`
+		TimeoutMs  *int               `json:"timeout_ms"`
+		Priority   string             `json:"priority"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error":"Невалидное тело"}`, http.StatusUnprocessableEntity)
 		return
 	}
 
+	timeout := o.Config.ExpressionTimeout
+	if req.TimeoutMs != nil {
+		if *req.TimeoutMs < 0 {
+			http.Error(w, `{"error":"timeout_ms не может быть отрицательным"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		timeout = time.Duration(*req.TimeoutMs) * time.Millisecond
+	}
+
+	priority := priorityNormal
+	if req.Priority != "" {
+		p, ok := priorityByName(req.Priority)
+		if !ok {
+			http.Error(w, `{"error":"Неизвестный приоритет"}`, http.StatusUnprocessableEntity)
+			return
+		}
+		if p > o.maxPriority(userID) {
+			http.Error(w, `{"error":"Приоритет недоступен пользователю"}`, http.StatusForbidden)
+			return
+		}
+		priority = p
+	}
+
 	dbExpr, err := o.Storage.CreateExpression(userID, req.Expression)
 	if err != nil {
 		http.Error(w, `{"error":"Не удалось создать выражение"}`, http.StatusInternalServerError)
 		return
 	}
 
+	if priority != priorityNormal {
+		if err := o.Storage.UpdateExpressionPriority(dbExpr.ID, priority); err != nil {
+			log.Printf("Не удалось сохранить приоритет выражения %d: %v", dbExpr.ID, err)
+		}
+	}
+
+	// Нулевой таймаут означает, что дедлайна у выражения нет.
+	if timeout > 0 {
+		if err := o.Storage.UpdateExpressionDeadline(dbExpr.ID, dbExpr.CreatedAt.Add(timeout)); err != nil {
+			log.Printf("Не удалось сохранить дедлайн выражения %d: %v", dbExpr.ID, err)
+		}
+	}
+
 	expr := &Expression{
 		ID:     strconv.Itoa(dbExpr.ID),
+		UserID: userID,
 		Expr:   req.Expression,
 		Status: "pending",
 	}
@@ -177,15 +481,68 @@ func (o *Orchestrator) calculateHandler(w http.ResponseWriter, r *http.Request)
 	ast, err := ParseAST(req.Expression)
 	if err != nil {
 		o.Storage.UpdateExpression(&storage.Expression{
-			ID:     dbExpr.ID,
-			Status: "error",
+			ID:          dbExpr.ID,
+			UserID:      userID,
+			Status:      "error",
+			ErrorReason: storage.ReasonParseError,
+		})
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       err.Error(),
+			"parse_error": parseErr,
+		})
+		return
+	}
+
+	if err := BindVariables(ast, req.Variables); err != nil {
+		o.Storage.UpdateExpression(&storage.Expression{
+			ID:          dbExpr.ID,
+			UserID:      userID,
+			Status:      "error",
+			ErrorReason: storage.ReasonUnboundVariables,
+		})
+		var unbound *UnboundVariablesError
+		errors.As(err, &unbound)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   err.Error(),
+			"missing": unbound.Names,
 		})
-		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
 		return
 	}
 
+	if req.Optimize {
+		ast, expr.TasksSaved = Optimize(ast)
+		if err := o.Storage.UpdateExpressionTasksSaved(dbExpr.ID, expr.TasksSaved); err != nil {
+			log.Printf("Не удалось сохранить статистику оптимизации выражения %s: %v", expr.ID, err)
+		}
+	}
+
 	expr.AST = ast
-	o.Tasks(expr)
+	defer o.tasksChanged.notify()
+	if err := o.Tasks(expr); err != nil {
+		o.Storage.UpdateExpression(&storage.Expression{
+			ID:          dbExpr.ID,
+			UserID:      userID,
+			Status:      "error",
+			ErrorReason: storage.ReasonInternalError,
+		})
+		http.Error(w, `{"error":"Не удалось создать задачи"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if astJSON, err := json.Marshal(ast); err != nil {
+		log.Printf("Не удалось сериализовать AST выражения %s: %v", expr.ID, err)
+	} else if err := o.Storage.UpdateExpressionAST(dbExpr.ID, string(astJSON)); err != nil {
+		log.Printf("Не удалось сохранить AST выражения %s: %v", expr.ID, err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -215,6 +572,9 @@ func (o *Orchestrator) expressionsHandler(w http.ResponseWriter, r *http.Request
 		if expr.Result != nil {
 			item["result"] = *expr.Result
 		}
+		if expr.ErrorReason != "" {
+			item["error_reason"] = expr.ErrorReason
+		}
 		response[i] = item
 	}
 
@@ -223,7 +583,7 @@ func (o *Orchestrator) expressionsHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (o *Orchestrator) expressionIDHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
 		http.Error(w, `{"error":"Неверный метод"}`, http.StatusMethodNotAllowed)
 		return
 	}
@@ -234,13 +594,27 @@ func (o *Orchestrator) expressionIDHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	idStr := r.URL.Path[len("/api/v1/expressions/"):]
+	idStr := r.URL.Path[len("/expressions/"):]
+	if strings.HasSuffix(idStr, "/ast") {
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"error":"Неверный метод"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		o.expressionASTHandler(w, userID, strings.TrimSuffix(idStr, "/ast"))
+		return
+	}
+
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		http.Error(w, `{"error":"Невалидное ID выражения"}`, http.StatusBadRequest)
 		return
 	}
 
+	if r.Method == http.MethodDelete {
+		o.deleteExpressionHandler(w, r, userID, id)
+		return
+	}
+
 	dbExpr, err := o.Storage.GetExpressionByID(id, userID)
 	if err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
@@ -251,48 +625,234 @@ func (o *Orchestrator) expressionIDHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	tasks, err := o.Storage.GetTasksByExpressionID(id)
+	if err != nil {
+		http.Error(w, `{"error":"Не удалось получить задачи"}`, http.StatusInternalServerError)
+		return
+	}
+
 	expr := &Expression{
-		ID:     idStr,
-		Expr:   dbExpr.Expression,
-		Status: dbExpr.Status,
-		Result: dbExpr.Result,
+		ID:         idStr,
+		Expr:       dbExpr.Expression,
+		Status:     dbExpr.Status,
+		Result:     dbExpr.Result,
+		Reason:     dbExpr.ErrorReason,
+		Priority:   priorityClasses[dbExpr.Priority],
+		Deadline:   dbExpr.Deadline,
+		TasksSaved: dbExpr.TasksSaved,
+		Plan:       taskPlan(tasks),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"expression": expr})
+}
 
-	response := map[string]interface{}{
-		"id":         idStr,
-		"expression": dbExpr.Expression,
-		"status":     dbExpr.Status,
+// deleteExpressionHandler отменяет вычисление выражения, а с параметром hard=true
+// удаляет выражение вместе с задачами.
+func (o *Orchestrator) deleteExpressionHandler(w http.ResponseWriter, r *http.Request, userID, id int) {
+	if r.URL.Query().Get("hard") == "true" {
+		if err := o.Storage.DeleteExpression(id, userID); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, `{"error":"Выражение не найдено"}`, http.StatusNotFound)
+				return
+			}
+			http.Error(w, `{"error":"Не удалось удалить выражение"}`, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
-	if dbExpr.Result != nil {
-		response["result"] = *dbExpr.Result
+
+	defer o.tasksChanged.notify()
+	if err := o.Storage.CancelExpression(id, userID); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			http.Error(w, `{"error":"Выражение не найдено"}`, http.StatusNotFound)
+		case errors.Is(err, storage.ErrNotPending):
+			http.Error(w, `{"error":"Выражение уже вычислено"}`, http.StatusConflict)
+		default:
+			http.Error(w, `{"error":"Не удалось отменить выражение"}`, http.StatusInternalServerError)
+		}
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"expression": response})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"expression": &Expression{ID: strconv.Itoa(id), Status: "cancelled"},
+	})
 }
 
-func (o *Orchestrator) getTaskHandler(w http.ResponseWriter, r *http.Request) {
-	task, err := o.Storage.GetPendingTask()
+func (o *Orchestrator) expressionASTHandler(w http.ResponseWriter, userID int, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, `{"error":"Невалидное ID выражения"}`, http.StatusBadRequest)
+		return
+	}
+
+	dbExpr, err := o.Storage.GetExpressionByID(id, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, `{"error":"Выражение не найдено"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Не удалось получить выражение"}`, http.StatusInternalServerError)
+		return
+	}
+
+	astJSON, err := o.Storage.GetExpressionAST(id, userID)
 	if err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
-			http.Error(w, `{"error":"No task available"}`, http.StatusNotFound)
+			http.Error(w, `{"error":"AST выражения недоступно"}`, http.StatusNotFound)
 			return
 		}
-		http.Error(w, `{"error":"Internal error"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error":"Не удалось получить AST"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var ast ASTNode
+	if err := json.Unmarshal([]byte(astJSON), &ast); err != nil {
+		http.Error(w, `{"error":"Не удалось разобрать AST"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tasks, err := o.Storage.GetTasksByExpressionID(id)
+	if err != nil {
+		http.Error(w, `{"error":"Не удалось получить задачи"}`, http.StatusInternalServerError)
+		return
+	}
+	byID := make(map[string]*storage.Task, len(tasks))
+	for _, t := range tasks {
+		byID[t.ID] = t
+	}
+	annotateAST(&ast, byID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":     idStr,
+		"status": dbExpr.Status,
+		"ast":    &ast,
+	})
+}
+
+func taskPlan(tasks []*storage.Task) []*PlanTask {
+	plan := make([]*PlanTask, 0, len(tasks))
+	byID := make(map[string]*PlanTask, len(tasks))
+	for _, t := range tasks {
+		pt := &PlanTask{
+			ID:         t.ID,
+			Operation:  t.Operation,
+			Arg1:       t.Arg1,
+			Arg2:       t.Arg2,
+			Arg1TaskID: t.Arg1TaskID.String,
+			Arg2TaskID: t.Arg2TaskID.String,
+			Status:     taskStatus(t),
+		}
+		if t.Completed && t.Result.Valid {
+			result := t.Result.Float64
+			pt.Result = &result
+		}
+		plan = append(plan, pt)
+		byID[pt.ID] = pt
+	}
+	for _, pt := range plan {
+		if d, ok := byID[pt.Arg1TaskID]; ok {
+			d.Consumers = append(d.Consumers, pt.ID)
+		}
+		if d, ok := byID[pt.Arg2TaskID]; ok && pt.Arg2TaskID != pt.Arg1TaskID {
+			d.Consumers = append(d.Consumers, pt.ID)
+		}
+	}
+	return plan
+}
+
+func annotateAST(node *ASTNode, tasks map[string]*storage.Task) {
+	if node == nil {
+		return
+	}
+	if t, ok := tasks[node.TaskID]; ok {
+		node.Status = taskStatus(t)
+		if t.Completed && t.Result.Valid {
+			result := t.Result.Float64
+			node.Result = &result
+		}
+	}
+	annotateAST(node.Left, tasks)
+	annotateAST(node.Right, tasks)
+	for _, arg := range node.Args {
+		annotateAST(arg, tasks)
+	}
+}
+
+// taskStatus — статус задачи для дерева разбора. Задача без владельца аренды
+// с lease_expires_at в будущем ждёт паузы перед повтором после ошибки.
+func taskStatus(t *storage.Task) string {
+	leased := t.LeaseExpires.Valid && time.Now().UnixMilli() < t.LeaseExpires.Int64
+	switch {
+	case t.Completed:
+		return "completed"
+	case t.DeadLettered.Valid:
+		return "dead_letter"
+	case t.Cancelled.Valid:
+		return "cancelled"
+	case leased && t.LeaseOwner.Valid:
+		return "in_progress"
+	case leased:
+		return "retrying"
+	default:
+		return "pending"
+	}
+}
+
+// internalTaskHandler — HTTP-ручка агентов, доступна только через agentMiddleware.
+func (o *Orchestrator) internalTaskHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		o.getTaskHandler(w, r)
+	case http.MethodPost:
+		o.postTaskHandler(w, r)
+	default:
+		http.Error(w, `{"error":"Неверный метод"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+func (o *Orchestrator) getTaskHandler(w http.ResponseWriter, r *http.Request) {
+	owner, err := agentIdentity(r.Context(), r.URL.Query().Get("agent_id"))
+	if err != nil {
+		http.Error(w, `{"error":"Доступ запрещён"}`, http.StatusForbidden)
+		return
+	}
+
+	var ops []string
+	if v := r.URL.Query().Get("operations"); v != "" {
+		ops = strings.Split(v, ",")
+	}
+	tasks, err := o.Storage.GetPendingTasks(owner, 1, o.agents.capabilities(owner, ops))
+	if err != nil {
+		http.Error(w, `{"error":"Internal error"}`, httpStatus(err))
+		return
+	}
+	if len(tasks) == 0 {
+		http.Error(w, `{"error":"No task available"}`, http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"task": task})
+	task := tasks[0]
+	json.NewEncoder(w).Encode(map[string]interface{}{"task": Task{
+		ID:            task.ID,
+		Arg1:          task.Arg1,
+		Arg2:          task.Arg2,
+		Operation:     task.Operation,
+		OperationTime: task.OperationTime,
+	}})
 }
 
 func (o *Orchestrator) postTaskHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result"`
+		ID           string  `json:"id"`
+		Result       float64 `json:"result"`
+		ErrorCode    string  `json:"error_code"`
+		ErrorMessage string  `json:"error_message"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -300,8 +860,18 @@ func (o *Orchestrator) postTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := o.Storage.CompleteTask(req.ID, req.Result); err != nil {
-		http.Error(w, `{"error":"Не удалось выполнить задание"}`, http.StatusInternalServerError)
+	owner, err := agentIdentity(r.Context(), "")
+	if err != nil {
+		http.Error(w, `{"error":"Доступ запрещён"}`, http.StatusForbidden)
+		return
+	}
+	if err := o.submitResult(owner, req.ID, req.Result, req.ErrorCode, req.ErrorMessage); err != nil {
+		code := httpStatus(err)
+		if code == http.StatusForbidden {
+			http.Error(w, `{"error":"Доступ запрещён"}`, code)
+			return
+		}
+		http.Error(w, `{"error":"Не удалось выполнить задание"}`, code)
 		return
 	}
 
@@ -309,90 +879,254 @@ func (o *Orchestrator) postTaskHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status":"result accepted"}`))
 }
 
-func (o *Orchestrator) Tasks(expr *Expression) {
+// terminalErrors — ошибки, которые повторятся при любом числе попыток, и причины,
+// с которыми из-за них завершается выражение. Такие задачи сразу уходят в dead letter.
+var terminalErrors = map[string]string{
+	agent.CodeDivisionByZero: storage.ReasonDivisionByZero,
+	agent.CodeModuloByZero:   storage.ReasonDivisionByZero,
+	agent.CodeDomain:         storage.ReasonDomainError,
+	agent.CodeOverflow:       storage.ReasonOverflow,
+}
+
+// submitResult принимает результат задачи. Если owner задан, задача должна быть
+// арендована этим агентом, иначе возвращается storage.ErrNotLeased. Результат
+// отменённой задачи отбрасывается с storage.ErrTaskCancelled.
+func (o *Orchestrator) submitResult(owner, id string, result float64, code, message string) error {
+	defer o.tasksChanged.notify()
+
+	if code == "" {
+		err := o.Storage.CompleteTask(id, owner, result)
+		if errors.Is(err, storage.ErrTaskCancelled) {
+			log.Printf("Результат отменённой задачи %s отброшен", id)
+		}
+		return err
+	}
+
+	reason, terminal := terminalErrors[code]
+	if !terminal {
+		reason = storage.ReasonInternalError
+	}
+
+	dead, err := o.Storage.FailTask(id, owner, storage.TaskError{
+		Code:      code,
+		Message:   message,
+		Reason:    reason,
+		Retryable: !terminal,
+	})
+	if errors.Is(err, storage.ErrTaskCancelled) {
+		log.Printf("Ошибка отменённой задачи %s отброшена: %s", id, code)
+	}
+	if err != nil {
+		return err
+	}
+	if dead {
+		log.Printf("Задача %s перемещена в dead letter: %s (%s)", id, code, message)
+	} else {
+		log.Printf("Задача %s будет повторена: %s (%s)", id, code, message)
+	}
+	return nil
+}
+
+// expireExpressions периодически снимает с вычисления выражения с истёкшим дедлайном.
+func (o *Orchestrator) expireExpressions(interval time.Duration) {
+	for range time.Tick(interval) {
+		ids, err := o.Storage.ExpireExpressions(time.Now())
+		if err != nil {
+			log.Printf("Ошибка при проверке дедлайнов выражений: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			log.Printf("Выражение %d не вычислено до дедлайна", id)
+		}
+	}
+}
+
+// DeadLetter — задача, которая больше не будет выдаваться агентам.
+type DeadLetter struct {
+	ID           string    `json:"id"`
+	ExpressionID int       `json:"expression_id"`
+	Operation    string    `json:"operation"`
+	Arg1         float64   `json:"arg1"`
+	Arg2         float64   `json:"arg2"`
+	Attempts     int       `json:"attempts"`
+	ErrorCode    string    `json:"error_code"`
+	ErrorMessage string    `json:"error_message,omitempty"`
+	FailedAt     time.Time `json:"failed_at"`
+}
+
+func (o *Orchestrator) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Неверный метод"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	tasks, err := o.Storage.GetDeadLetterTasks()
+	if err != nil {
+		log.Printf("Ошибка при получении dead letter задач: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	letters := make([]*DeadLetter, 0, len(tasks))
+	for _, t := range tasks {
+		letters = append(letters, &DeadLetter{
+			ID:           t.ID,
+			ExpressionID: t.ExprID,
+			Operation:    t.Operation,
+			Arg1:         t.Arg1,
+			Arg2:         t.Arg2,
+			Attempts:     t.Attempts,
+			ErrorCode:    t.ErrorCode.String,
+			ErrorMessage: t.ErrorMessage.String,
+			FailedAt:     t.DeadLettered.Time,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tasks": letters})
+}
+
+func (o *Orchestrator) operationTime(operator string) int {
+	switch operator {
+	case "+":
+		return o.Config.TimeAddition
+	case "-":
+		return o.Config.TimeSubtraction
+	case "*":
+		return o.Config.TimeMultiplications
+	case "/":
+		return o.Config.TimeDivisions
+	case "^":
+		return o.Config.TimePower
+	case "%":
+		return o.Config.TimeModulo
+	case "//":
+		return o.Config.TimeIntDivisions
+	case "neg":
+		return o.Config.TimeNegation
+	default:
+		if t, ok := o.Config.TimeFunctions[operator]; ok {
+			return t
+		}
+		return 100
+	}
+}
+
+type taskOperand struct {
+	task  *storage.Task
+	value float64
+	key   string // структурный ключ поддерева для поиска общих подвыражений
+}
+
+func (o *Orchestrator) Tasks(expr *Expression) error {
 	log.Printf("Создание задач для выражения %s", expr.ID)
 	exprID, _ := strconv.Atoi(expr.ID)
 
-	var stack []*ASTNode
+	if expr.AST.IsLeaf {
+		result := expr.AST.Value
+		return o.Storage.UpdateExpression(&storage.Expression{
+			ID:     exprID,
+			UserID: expr.UserID,
+			Status: "completed",
+			Result: &result,
+		})
+	}
+
 	var tasks []*Task
+	var dbTasks []*storage.Task
+	scheduled := make(map[string]taskOperand)
+	nodeTasks := make(map[*ASTNode]*storage.Task)
+
+	newTask := func(node *ASTNode, arg1, arg2 taskOperand) taskOperand {
+		key := node.Operator + "(" + arg1.key
+		if arg2.key != "" {
+			key += "," + arg2.key
+		}
+		key += ")"
+		if op, ok := scheduled[key]; ok {
+			return op
+		}
 
-	var postOrder func(node *ASTNode)
-	postOrder = func(node *ASTNode) {
-		if node == nil {
-			return
+		dbTask := &storage.Task{
+			ExprID:        exprID,
+			Arg1:          arg1.value,
+			Arg2:          arg2.value,
+			Operation:     node.Operator,
+			OperationTime: o.operationTime(node.Operator),
+			Left:          arg1.task,
+			Right:         arg2.task,
 		}
 
-		postOrder(node.Left)
-		postOrder(node.Right)
+		dbTasks = append(dbTasks, dbTask)
+		tasks = append(tasks, &Task{
+			ExprID:        expr.ID,
+			Arg1:          dbTask.Arg1,
+			Arg2:          dbTask.Arg2,
+			Operation:     dbTask.Operation,
+			OperationTime: dbTask.OperationTime,
+			Node:          node,
+		})
 
-		if !node.IsLeaf {
-			if len(stack) < 2 {
-				log.Printf("Недостаточно операндов для выполнения %s", node.Operator)
-				return
-			}
+		op := taskOperand{task: dbTask, key: key}
+		scheduled[key] = op
+		return op
+	}
 
-			right := stack[len(stack)-1]
-			left := stack[len(stack)-2]
-			stack = stack[:len(stack)-2]
-
-			o.taskCounter++
-			taskID := fmt.Sprintf("%d", o.taskCounter)
-
-			var opTime int
-			switch node.Operator {
-			case "+":
-				opTime = o.Config.TimeAddition
-			case "-":
-				opTime = o.Config.TimeSubtraction
-			case "*":
-				opTime = o.Config.TimeMultiplications
-			case "/":
-				opTime = o.Config.TimeDivisions
-			default:
-				opTime = 100
-			}
+	var postOrder func(node *ASTNode) taskOperand
+	postOrder = func(node *ASTNode) taskOperand {
+		if node == nil {
+			return taskOperand{}
+		}
+		if node.IsLeaf {
+			return taskOperand{value: node.Value, key: strconv.FormatFloat(node.Value, 'g', -1, 64)}
+		}
 
-			task := &Task{
-				ID:            taskID,
-				ExprID:        expr.ID,
-				Arg1:          left.Value,
-				Arg2:          right.Value,
-				Operation:     node.Operator,
-				OperationTime: opTime,
-				Node:          node,
+		var result taskOperand
+		if len(node.Args) > 0 {
+			result = postOrder(node.Args[0])
+			if len(node.Args) == 1 {
+				result = newTask(node, result, taskOperand{})
 			}
-
-			tasks = append(tasks, task)
-
-			resultNode := &ASTNode{
-				IsLeaf: true,
-				Value:  0,
+			for _, arg := range node.Args[1:] {
+				result = newTask(node, result, postOrder(arg))
 			}
-			stack = append(stack, resultNode)
 		} else {
-			stack = append(stack, node)
+			left := postOrder(node.Left)
+			right := postOrder(node.Right)
+			result = newTask(node, left, right)
 		}
+		nodeTasks[node] = result.task
+		return result
 	}
 
 	postOrder(expr.AST)
 
-	for _, task := range tasks {
-		if err := o.Storage.CreateTask(&storage.Task{
-			ID:            task.ID,
-			ExprID:        exprID,
-			Arg1:          task.Arg1,
-			Arg2:          task.Arg2,
-			Operation:     task.Operation,
-			OperationTime: task.OperationTime,
-		}); err != nil {
-			log.Printf("Не удалось создать задачу: %v", err)
-			continue
-		}
+	if err := o.Storage.CreateTasks(dbTasks); err != nil {
+		log.Printf("Не удалось создать задачи: %v", err)
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for node, dbTask := range nodeTasks {
+		node.TaskID = dbTask.ID
+		node.TaskScheduled = true
+	}
+	for i, task := range tasks {
+		task.ID = dbTasks[i].ID
 		o.taskStore[task.ID] = task
 		o.taskQueue = append(o.taskQueue, task)
-		log.Printf("Создана задача %s: %.2f %s %.2f",
-			task.ID, task.Arg1, task.Operation, task.Arg2)
+		log.Printf("Создана задача %s: %s %s %s",
+			task.ID, taskArg(task.Arg1, dbTasks[i].Left), task.Operation, taskArg(task.Arg2, dbTasks[i].Right))
 	}
+	return nil
+}
+
+func taskArg(value float64, dep *storage.Task) string {
+	if dep != nil {
+		return "#" + dep.ID
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64)
 }
 
 func (o *Orchestrator) registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -523,15 +1257,90 @@ func (o *Orchestrator) authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// Классы приоритета выражений, индекс — значение в хранилище.
+var priorityClasses = []string{"low", "normal", "high"}
+
+const (
+	priorityNormal = 1
+	priorityHigh   = 2
+)
+
+func priorityByName(name string) (int, bool) {
+	for p, class := range priorityClasses {
+		if class == name {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// maxPriority — наибольший приоритет, доступный пользователю: high только администраторам.
+func (o *Orchestrator) maxPriority(userID int) int {
+	if o.isAdmin(userID) {
+		return priorityHigh
+	}
+	return priorityNormal
+}
+
+func (o *Orchestrator) isAdmin(userID int) bool {
+	user, err := o.Storage.GetUserByID(userID)
+	return err == nil && o.Config.AdminLogins[user.Login]
+}
+
+// adminMiddleware пропускает только пользователей, перечисленных в ADMIN_LOGINS.
+func (o *Orchestrator) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok {
+			http.Error(w, `{"error":"Не авторизован"}`, http.StatusUnauthorized)
+			return
+		}
+
+		if !o.isAdmin(userID) {
+			http.Error(w, `{"error":"Доступ запрещён"}`, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (o *Orchestrator) serveInternal(handler http.Handler) {
+	cfg, err := o.serverTLSConfig()
+	if err != nil {
+		log.Fatalf("failed to configure internal HTTP: %v", err)
+	}
+	srv := &http.Server{Addr: ":" + o.Config.InternalHTTPAddr, Handler: handler, TLSConfig: cfg}
+
+	log.Printf("Запускаем HTTP сервер для агентов на порту %s", o.Config.InternalHTTPAddr)
+	if cfg != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	log.Fatalf("failed to serve internal HTTP: %v", err)
+}
+
 func (o *Orchestrator) RunServer() error {
 	lis, err := net.Listen("tcp", ":"+o.Config.GRPCAddr)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	opts, err := o.grpcServerOptions()
+	if err != nil {
+		return fmt.Errorf("failed to configure gRPC: %v", err)
+	}
+	grpcServer := grpc.NewServer(opts...)
 	proto.RegisterCalculatorServer(grpcServer, &server{o: o})
 
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, hs)
+	go o.watchHealth(hs, healthCheckInterval)
+
+	if o.Config.GRPCReflection {
+		reflection.Register(grpcServer)
+	}
+
 	go func() {
 		log.Printf("Запускаем gRPC сервер на порту %s", o.Config.GRPCAddr)
 		if err := grpcServer.Serve(lis); err != nil {
@@ -548,20 +1357,29 @@ func (o *Orchestrator) RunServer() error {
 	protected.HandleFunc("/calculate", o.calculateHandler)
 	protected.HandleFunc("/expressions", o.expressionsHandler)
 	protected.HandleFunc("/expressions/", o.expressionIDHandler)
-	protected.HandleFunc("/internal/task", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			o.getTaskHandler(w, r)
-		} else if r.Method == http.MethodPost {
-			o.postTaskHandler(w, r)
-		}
-	})
+	protected.HandleFunc("/admin/dead-letters", o.adminMiddleware(o.deadLettersHandler))
+	protected.HandleFunc("/admin/agents", o.adminMiddleware(o.agentsHandler))
+	protected.HandleFunc("/admin/grpc-metrics", o.adminMiddleware(o.grpcMetricsHandler))
 
 	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", o.authMiddleware(protected)))
 
+	// Ручки агентов не проходят через JWT пользователей. С INTERNAL_HTTP_ADDR они
+	// доступны только на отдельном порту (с TLS/mTLS, если задан сертификат).
+	if o.Config.InternalHTTPAddr != "" {
+		internal := http.NewServeMux()
+		internal.HandleFunc("/api/v1/internal/task", o.agentMiddleware(o.internalTaskHandler))
+		go o.serveInternal(internal)
+	} else {
+		mux.HandleFunc("/api/v1/internal/task", o.agentMiddleware(o.internalTaskHandler))
+	}
+
 	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"API Not Found"}`, http.StatusNotFound)
 	})
 
+	go o.expireExpressions(500 * time.Millisecond)
+	go o.expireAgents(o.Config.HeartbeatInterval)
+
 	go func() {
 		for {
 			time.Sleep(2 * time.Second)
@@ -0,0 +1,924 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"calc_service/internal/agent"
+	"calc_service/internal/auth"
+	"calc_service/internal/proto"
+	"calc_service/internal/storage"
+)
+
+func setupTestOrchestrator(t *testing.T) (*Orchestrator, int) {
+	t.Helper()
+	st, err := storage.NewStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("не удалось создать хранилище: %v", err)
+	}
+	t.Cleanup(func() { st.GetDB().Close() })
+
+	userID, err := st.CreateUser("testuser", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser не удалось: %v", err)
+	}
+
+	return &Orchestrator{
+		Config:    Configuration(),
+		Storage:   st,
+		exprStore: make(map[string]*Expression),
+		taskStore: make(map[string]*Task),
+		taskQueue: make([]*Task, 0),
+	}, userID
+}
+
+func scheduleExpression(t *testing.T, o *Orchestrator, userID int, input string, vars map[string]float64) (*Expression, []*storage.Task) {
+	t.Helper()
+	dbExpr, err := o.Storage.CreateExpression(userID, input)
+	if err != nil {
+		t.Fatalf("CreateExpression не удалось: %v", err)
+	}
+	ast, err := ParseAST(input)
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+	if err := BindVariables(ast, vars); err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+
+	expr := &Expression{ID: strconv.Itoa(dbExpr.ID), UserID: userID, Expr: input, AST: ast}
+	if err := o.Tasks(expr); err != nil {
+		t.Fatalf("Tasks не удалось: %v", err)
+	}
+	tasks, err := o.Storage.GetTasksByExpressionID(dbExpr.ID)
+	if err != nil {
+		t.Fatalf("GetTasksByExpressionID не удалось: %v", err)
+	}
+	return expr, tasks
+}
+
+func TestTasksCommonSubexpressions(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+
+	expr, tasks := scheduleExpression(t, o, userID, "(a+b)*(a+b)/(a+b)", map[string]float64{"a": 1, "b": 2})
+	if len(tasks) != 3 {
+		t.Fatalf("ожидалось 3 задачи, получено: %d", len(tasks))
+	}
+
+	sum, mul, div := tasks[0], tasks[1], tasks[2]
+	if sum.Operation != "+" || mul.Operation != "*" || div.Operation != "/" {
+		t.Fatalf("неожиданный план: %s %s %s", sum.Operation, mul.Operation, div.Operation)
+	}
+	if mul.Arg1TaskID.String != sum.ID || mul.Arg2TaskID.String != sum.ID {
+		t.Errorf("умножение должно использовать задачу %s дважды, имеем: %+v", sum.ID, mul)
+	}
+	if div.Arg1TaskID.String != mul.ID || div.Arg2TaskID.String != sum.ID {
+		t.Errorf("деление должно использовать задачи %s и %s, имеем: %+v", mul.ID, sum.ID, div)
+	}
+
+	root := expr.AST
+	if root.Right.TaskID != sum.ID || root.Left.Left.TaskID != sum.ID || root.Left.Right.TaskID != sum.ID {
+		t.Errorf("все копии подвыражения должны ссылаться на задачу %s", sum.ID)
+	}
+
+	plan := taskPlan(tasks)
+	if len(plan[0].Consumers) != 2 {
+		t.Errorf("ожидалось 2 потребителя у задачи %s, имеем: %v", sum.ID, plan[0].Consumers)
+	}
+}
+
+func TestTasksDistinctSubexpressions(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+
+	tests := []struct {
+		expr  string
+		tasks int
+	}{
+		{expr: "(1+2)*(2+1)", tasks: 3},
+		{expr: "(1-2)*(1-2)", tasks: 2},
+		{expr: "max(1, 2, 3) + max(1, 2)", tasks: 3},
+		{expr: "-x*-x", tasks: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, tasks := scheduleExpression(t, o, userID, tt.expr, map[string]float64{"x": 2})
+			if len(tasks) != tt.tasks {
+				t.Errorf("ожидалось задач: %d, получено: %d", tt.tasks, len(tasks))
+			}
+		})
+	}
+}
+
+func TestSubmitResultErrors(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+
+	tests := []struct {
+		name string
+		code string
+		dead bool
+	}{
+		{"Деление на ноль сразу уходит в dead letter", agent.CodeDivisionByZero, true},
+		{"Переполнение сразу уходит в dead letter", agent.CodeOverflow, true},
+		{"Временная ошибка повторяется", agent.CodeInternal, false},
+		{"Неподдерживаемая операция повторяется", agent.CodeInvalidOperator, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, tasks := scheduleExpression(t, o, userID, "1/0", nil)
+			if err := o.submitResult("", tasks[0].ID, 0, tt.code, "ошибка"); err != nil {
+				t.Fatalf("submitResult не удалось: %v", err)
+			}
+
+			task, err := o.Storage.GetTaskByID(tasks[0].ID)
+			if err != nil {
+				t.Fatalf("GetTaskByID не удалось: %v", err)
+			}
+			if task.DeadLettered.Valid != tt.dead || task.ErrorCode.String != tt.code {
+				t.Errorf("неверная обработка ошибки %s, имеем: %+v", tt.code, task)
+			}
+		})
+	}
+}
+
+func TestTaskStatus(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	_, tasks := scheduleExpression(t, o, userID, "1+1", nil)
+
+	current := func() string {
+		task, err := o.Storage.GetTaskByID(tasks[0].ID)
+		if err != nil {
+			t.Fatalf("GetTaskByID не удалось: %v", err)
+		}
+		return taskStatus(task)
+	}
+	if s := current(); s != "pending" {
+		t.Errorf("новая задача должна ожидать агента, имеем: %s", s)
+	}
+
+	if _, err := o.Storage.GetPendingTask("agent-1"); err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	if s := current(); s != "in_progress" {
+		t.Errorf("арендованная задача должна выполняться, имеем: %s", s)
+	}
+
+	if err := o.submitResult("agent-1", tasks[0].ID, 0, agent.CodeInvalidOperator, "invalid operator"); err != nil {
+		t.Fatalf("submitResult не удалось: %v", err)
+	}
+	if s := current(); s != "retrying" {
+		t.Errorf("задача после временной ошибки должна ждать повтора, имеем: %s", s)
+	}
+}
+
+func TestTerminalErrorCancelsTasks(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+
+	expr, tasks := scheduleExpression(t, o, userID, "1/0+2*3", nil)
+	if len(tasks) != 3 {
+		t.Fatalf("ожидалось 3 задачи, получено: %d", len(tasks))
+	}
+	div, mul := tasks[0], tasks[1]
+
+	if err := o.submitResult("", div.ID, 0, agent.CodeDivisionByZero, "division by zero"); err != nil {
+		t.Fatalf("submitResult не удалось: %v", err)
+	}
+
+	id, _ := strconv.Atoi(expr.ID)
+	dbExpr, err := o.Storage.GetExpressionByID(id, userID)
+	if err != nil {
+		t.Fatalf("GetExpressionByID не удалось: %v", err)
+	}
+	if dbExpr.Status != "error" || dbExpr.ErrorReason != storage.ReasonDivisionByZero {
+		t.Errorf("ожидалась ошибка %s, имеем: %+v", storage.ReasonDivisionByZero, dbExpr)
+	}
+
+	tasks, err = o.Storage.GetTasksByExpressionID(id)
+	if err != nil {
+		t.Fatalf("GetTasksByExpressionID не удалось: %v", err)
+	}
+	statuses := []string{taskStatus(tasks[0]), taskStatus(tasks[1]), taskStatus(tasks[2])}
+	if statuses[0] != "dead_letter" || statuses[1] != "cancelled" || statuses[2] != "cancelled" {
+		t.Errorf("оставшиеся задачи должны быть отменены, имеем: %v", statuses)
+	}
+
+	if _, err := o.Storage.GetPendingTask("agent-1"); err != storage.ErrNotFound {
+		t.Errorf("отменённые задачи не должны выдаваться агентам, имеем: %v", err)
+	}
+	if err := o.submitResult("", mul.ID, 6, "", ""); err != storage.ErrTaskCancelled {
+		t.Errorf("результат отменённой задачи должен отбрасываться с ErrTaskCancelled, имеем: %v", err)
+	}
+	if got, _ := o.Storage.GetTaskByID(mul.ID); got.Completed {
+		t.Errorf("отменённая задача не должна завершаться, имеем: %+v", got)
+	}
+}
+
+func TestNonFiniteResultReason(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+
+	tests := []struct {
+		name   string
+		result float64
+		reason string
+	}{
+		{"NaN", math.NaN(), storage.ReasonDomainError},
+		{"Бесконечность", math.Inf(1), storage.ReasonOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, tasks := scheduleExpression(t, o, userID, "2^3", nil)
+			if err := o.submitResult("", tasks[0].ID, tt.result, "", ""); err != nil {
+				t.Fatalf("submitResult не удалось: %v", err)
+			}
+
+			id, _ := strconv.Atoi(expr.ID)
+			dbExpr, _ := o.Storage.GetExpressionByID(id, userID)
+			if dbExpr.Status != "error" || dbExpr.ErrorReason != tt.reason {
+				t.Errorf("ожидалась ошибка %s, имеем: %+v", tt.reason, dbExpr)
+			}
+		})
+	}
+}
+
+func TestDeleteExpressionHandler(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	expr, _ := scheduleExpression(t, o, userID, "2+2", nil)
+
+	tests := []struct {
+		name   string
+		query  string
+		userID int
+		code   int
+	}{
+		{"Чужое выражение", "", userID + 1, http.StatusNotFound},
+		{"Отмена", "", userID, http.StatusOK},
+		{"Повторная отмена", "", userID, http.StatusConflict},
+		{"Удаление", "?hard=true", userID, http.StatusNoContent},
+		{"Удалённое выражение", "?hard=true", userID, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/expressions/"+expr.ID+tt.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), "userID", tt.userID))
+			rec := httptest.NewRecorder()
+
+			o.expressionIDHandler(rec, req)
+			if rec.Code != tt.code {
+				t.Errorf("ожидался код %d, имеем: %d (%s)", tt.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCalculatePriority(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	adminID, err := o.Storage.CreateUser("admin", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser не удалось: %v", err)
+	}
+	o.Config.AdminLogins = map[string]bool{"admin": true}
+
+	tests := []struct {
+		name     string
+		userID   int
+		priority string
+		code     int
+		expected int
+	}{
+		{"По умолчанию", userID, "", http.StatusCreated, priorityNormal},
+		{"Низкий приоритет", userID, "low", http.StatusCreated, 0},
+		{"Высокий приоритет запрещён пользователю", userID, "high", http.StatusForbidden, 0},
+		{"Высокий приоритет администратора", adminID, "high", http.StatusCreated, priorityHigh},
+		{"Неизвестный приоритет", userID, "urgent", http.StatusUnprocessableEntity, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"expression":"1+1","priority":"` + tt.priority + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/calculate", strings.NewReader(body))
+			req = req.WithContext(context.WithValue(req.Context(), "userID", tt.userID))
+			rec := httptest.NewRecorder()
+
+			o.calculateHandler(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("ожидался код %d, имеем: %d (%s)", tt.code, rec.Code, rec.Body.String())
+			}
+			if tt.code != http.StatusCreated {
+				return
+			}
+
+			var resp struct {
+				ID string `json:"id"`
+			}
+			json.NewDecoder(rec.Body).Decode(&resp)
+			id, _ := strconv.Atoi(resp.ID)
+			expr, err := o.Storage.GetExpressionByID(id, tt.userID)
+			if err != nil {
+				t.Fatalf("GetExpressionByID не удалось: %v", err)
+			}
+			if expr.Priority != tt.expected {
+				t.Errorf("ожидался приоритет %d, имеем: %d", tt.expected, expr.Priority)
+			}
+		})
+	}
+}
+
+func TestServerBatches(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	o.Config.MaxBatchSize = 2
+	s := &server{o: o}
+
+	for i := 0; i < 3; i++ {
+		scheduleExpression(t, o, userID, "1+1", nil)
+	}
+
+	batch, err := s.GetTasks(context.Background(), &proto.TaskRequest{ComputingPower: 16, AgentId: "agent-1"})
+	if err != nil {
+		t.Fatalf("GetTasks не удалось: %v", err)
+	}
+	if len(batch.Tasks) != 2 {
+		t.Fatalf("размер пачки должен ограничиваться MaxBatchSize, имеем: %d", len(batch.Tasks))
+	}
+
+	resp, err := s.SubmitResults(context.Background(), &proto.ResultBatch{Results: []*proto.ResultRequest{
+		{Id: batch.Tasks[0].Id, Result: 2},
+		{Id: batch.Tasks[1].Id, Result: 2},
+		{Id: "999", Result: 2},
+	}})
+	if err != nil {
+		t.Fatalf("SubmitResults не удалось: %v", err)
+	}
+	if resp.Accepted != 2 || len(resp.FailedIds) != 1 || resp.FailedIds[0] != "999" {
+		t.Errorf("неверный ответ на пачку результатов: %+v", resp)
+	}
+
+	batch, err = s.GetTasks(context.Background(), &proto.TaskRequest{ComputingPower: 1, AgentId: "agent-1"})
+	if err != nil {
+		t.Fatalf("GetTasks не удалось: %v", err)
+	}
+	if len(batch.Tasks) != 1 {
+		t.Errorf("ожидалась одна оставшаяся задача, имеем: %d", len(batch.Tasks))
+	}
+}
+
+type fakeTaskStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	tasks chan *proto.TaskResponse
+}
+
+func (f *fakeTaskStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeTaskStream) Send(task *proto.TaskResponse) error {
+	f.tasks <- task
+	return nil
+}
+
+func TestStreamTasksFlowControl(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	s := &server{o: o}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeTaskStream{ctx: ctx, tasks: make(chan *proto.TaskResponse, 10)}
+	done := make(chan error)
+	go func() {
+		done <- s.StreamTasks(&proto.TaskRequest{ComputingPower: 1, AgentId: "agent-1"}, stream)
+	}()
+
+	receive := func() *proto.TaskResponse {
+		t.Helper()
+		select {
+		case task := <-stream.tasks:
+			return task
+		case <-time.After(time.Second):
+			t.Fatalf("задача не пришла в поток")
+			return nil
+		}
+	}
+
+	scheduleExpression(t, o, userID, "1+1", nil)
+	o.tasksChanged.notify()
+	first := receive()
+
+	scheduleExpression(t, o, userID, "2+2", nil)
+	o.tasksChanged.notify()
+	select {
+	case task := <-stream.tasks:
+		t.Fatalf("агенту без свободных воркеров не должны отправляться задачи, получена: %s", task.Id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := o.submitResult("", first.Id, 2, "", ""); err != nil {
+		t.Fatalf("submitResult не удалось: %v", err)
+	}
+	if second := receive(); second.Id == first.Id {
+		t.Errorf("ожидалась следующая задача, получена повторно: %s", second.Id)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("поток должен завершаться без ошибки при отключении агента, имеем: %v", err)
+	}
+}
+
+func TestAgentRegistry(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	o.Config.AgentTimeout = time.Minute
+	s := &server{o: o}
+
+	if _, err := s.Heartbeat(context.Background(), &proto.HeartbeatRequest{AgentId: "agent-1"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("heartbeat незарегистрированного агента должен вернуть NotFound, имеем: %v", err)
+	}
+
+	ack, err := s.RegisterAgent(context.Background(), &proto.AgentInfo{
+		AgentId:    "agent-1",
+		Hostname:   "host",
+		Version:    "1.0.0",
+		Workers:    4,
+		Operations: []string{"+", "-"},
+	})
+	if err != nil {
+		t.Fatalf("RegisterAgent не удалось: %v", err)
+	}
+	if ack.HeartbeatIntervalMs != int32(o.Config.HeartbeatInterval.Milliseconds()) {
+		t.Errorf("неверный интервал heartbeat: %d", ack.HeartbeatIntervalMs)
+	}
+	if _, err := s.Heartbeat(context.Background(), &proto.HeartbeatRequest{AgentId: "agent-1"}); err != nil {
+		t.Fatalf("Heartbeat не удалось: %v", err)
+	}
+
+	scheduleExpression(t, o, userID, "1+1", nil)
+	task, err := o.Storage.GetPendingTask("agent-1")
+	if err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/agents", nil)
+	rec := httptest.NewRecorder()
+	o.agentsHandler(rec, req)
+	var resp struct {
+		Agents []AgentInfo `json:"agents"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("не удалось разобрать ответ: %v", err)
+	}
+	if len(resp.Agents) != 1 || resp.Agents[0].ID != "agent-1" || resp.Agents[0].LeasedTasks != 1 {
+		t.Errorf("неверный список агентов: %+v", resp.Agents)
+	}
+
+	o.releaseExpiredAgents(time.Now().Add(30 * time.Second))
+	if len(o.agents.list()) != 1 {
+		t.Fatalf("агент не должен истекать раньше таймаута")
+	}
+
+	o.releaseExpiredAgents(time.Now().Add(2 * time.Minute))
+	if len(o.agents.list()) != 0 {
+		t.Errorf("молчащий агент должен удаляться из реестра")
+	}
+	reclaimed, err := o.Storage.GetPendingTask("agent-2")
+	if err != nil || reclaimed.ID != task.ID {
+		t.Fatalf("задача молчащего агента должна вернуться в очередь, имеем: %+v, %v", reclaimed, err)
+	}
+
+	// Задача, исчерпавшая попытки у молчащего агента, уходит в dead letter, а не зависает.
+	o.Storage.MaxAttempts = reclaimed.Attempts
+	if _, err := s.RegisterAgent(context.Background(), &proto.AgentInfo{AgentId: "agent-2"}); err != nil {
+		t.Fatalf("RegisterAgent не удалось: %v", err)
+	}
+	o.releaseExpiredAgents(time.Now().Add(2 * time.Minute))
+	if _, err := o.Storage.GetPendingTask("agent-3"); err != storage.ErrNotFound {
+		t.Errorf("задача с исчерпанными попытками не должна выдаваться, имеем: %v", err)
+	}
+	dead, err := o.Storage.GetTaskByID(task.ID)
+	if err != nil || !dead.DeadLettered.Valid || dead.ErrorCode.String != storage.CodeLeaseExpired {
+		t.Errorf("задача должна попасть в dead letter с кодом %s, имеем: %+v, %v", storage.CodeLeaseExpired, dead, err)
+	}
+	expr, err := o.Storage.GetExpressionByID(dead.ExprID, userID)
+	if err != nil || expr.Status != "error" {
+		t.Errorf("выражение должно завершиться ошибкой, имеем: %+v, %v", expr, err)
+	}
+}
+
+func TestCapabilityRouting(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	s := &server{o: o}
+
+	if _, err := s.RegisterAgent(context.Background(), &proto.AgentInfo{
+		AgentId:    "adder",
+		Operations: []string{"+"},
+	}); err != nil {
+		t.Fatalf("RegisterAgent не удалось: %v", err)
+	}
+
+	scheduleExpression(t, o, userID, "2*3+1", nil)
+
+	batch, err := s.GetTasks(context.Background(), &proto.TaskRequest{ComputingPower: 4, AgentId: "adder"})
+	if err != nil {
+		t.Fatalf("GetTasks не удалось: %v", err)
+	}
+	if len(batch.Tasks) != 0 {
+		t.Fatalf("агенту не должны выдаваться неподдерживаемые операции, имеем: %+v", batch.Tasks)
+	}
+
+	// unroutable возвращает готовые задачи, которые не может выполнить ни один агент.
+	unroutable := func() map[string]int {
+		rec := httptest.NewRecorder()
+		o.agentsHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/agents", nil))
+		var resp struct {
+			Unroutable map[string]int `json:"unroutable_operations"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("не удалось разобрать ответ: %v", err)
+		}
+		return resp.Unroutable
+	}
+	if ops := unroutable(); len(ops) != 1 || ops["*"] != 1 {
+		t.Errorf("ожидалась неразрешимая операция *, имеем: %v", ops)
+	}
+
+	batch, err = s.GetTasks(context.Background(), &proto.TaskRequest{ComputingPower: 4, AgentId: "unregistered", Operations: []string{"+"}})
+	if err != nil || len(batch.Tasks) != 0 {
+		t.Errorf("незарегистрированному агенту выдаются только операции из запроса, имеем: %+v, %v", batch, err)
+	}
+	rec := httptest.NewRecorder()
+	o.getTaskHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/internal/task?agent_id=http&operations=%2B", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("HTTP-агенту выдаются только операции из запроса, имеем %d: %s", rec.Code, rec.Body.String())
+	}
+	if ops := unroutable(); len(ops) != 1 || ops["*"] != 1 {
+		t.Errorf("операция * не поддерживается и незарегистрированными агентами, имеем: %v", ops)
+	}
+
+	batch, err = s.GetTasks(context.Background(), &proto.TaskRequest{ComputingPower: 4, AgentId: "unregistered"})
+	if err != nil || len(batch.Tasks) != 1 || batch.Tasks[0].Operation != "*" {
+		t.Errorf("агент, не сообщивший операции, получает любые, имеем: %+v, %v", batch, err)
+	}
+
+	// Незарегистрированный агент без ограничений выполняет любые операции, пока
+	// запрашивает задачи, а после AGENT_TIMEOUT_MS без запросов перестаёт учитываться.
+	scheduleExpression(t, o, userID, "4*5", nil)
+	if ops := unroutable(); len(ops) != 0 {
+		t.Errorf("операции должны выполняться незарегистрированным агентом, имеем: %v", ops)
+	}
+	o.releaseExpiredAgents(time.Now().Add(2 * time.Minute))
+	if ops := unroutable(); len(ops) != 1 || ops["*"] != 1 {
+		t.Errorf("после таймаута агентов операция * неразрешима, имеем: %v", ops)
+	}
+}
+
+func TestAgentAuthentication(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	o.Config.AgentTokens = parseAgentTokens("agent-1:secret1, agent-2:secret2")
+	s := &server{o: o}
+
+	// authed пропускает вызов через перехватчик и возвращает контекст обработчика.
+	authed := func(token string) (context.Context, error) {
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+		}
+		var handlerCtx context.Context
+		_, err := o.agentAuthUnary(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			handlerCtx = ctx
+			return nil, nil
+		})
+		return handlerCtx, err
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if _, err := authed(token); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("токен %q: ожидался Unauthenticated, имеем: %v", token, err)
+		}
+	}
+
+	agent1, err := authed("secret1")
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+	agent2, err := authed("secret2")
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+
+	if _, err := s.GetTasks(agent2, &proto.TaskRequest{ComputingPower: 1, AgentId: "agent-1"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("агент не должен представляться чужим ID, имеем: %v", err)
+	}
+
+	// Без agent_id агент получает ID из токена.
+	if _, err := s.RegisterAgent(agent2, &proto.AgentInfo{}); err != nil {
+		t.Fatalf("RegisterAgent без agent_id не удалось: %v", err)
+	}
+	if _, err := s.Heartbeat(agent2, &proto.HeartbeatRequest{}); err != nil {
+		t.Errorf("Heartbeat без agent_id не удалось: %v", err)
+	}
+	if agents := o.agents.list(); len(agents) != 1 || agents[0].ID != "agent-2" {
+		t.Errorf("агент должен зарегистрироваться под ID из токена, имеем: %+v", agents)
+	}
+
+	scheduleExpression(t, o, userID, "1+1", nil)
+	batch, err := s.GetTasks(agent1, &proto.TaskRequest{ComputingPower: 1})
+	if err != nil || len(batch.Tasks) != 1 {
+		t.Fatalf("ожидалась одна задача, имеем: %+v, %v", batch, err)
+	}
+	task := batch.Tasks[0]
+
+	if _, err := s.SubmitResult(agent2, &proto.ResultRequest{Id: task.Id, Result: 2}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("результат чужой задачи должен отклоняться, имеем: %v", err)
+	}
+	resp, err := s.SubmitResults(agent2, &proto.ResultBatch{Results: []*proto.ResultRequest{{Id: task.Id, Result: 2}}})
+	if err != nil || resp.Accepted != 0 || len(resp.FailedIds) != 1 {
+		t.Errorf("результат чужой задачи должен попасть в failed_ids, имеем: %+v, %v", resp, err)
+	}
+	if _, err := s.SubmitResult(agent1, &proto.ResultRequest{Id: task.Id, Result: 2}); err != nil {
+		t.Errorf("SubmitResult не удалось: %v", err)
+	}
+}
+
+func TestAgentCertificateAuthentication(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	s := &server{o: o}
+
+	// withCert пропускает вызов агента с клиентским сертификатом cn через перехватчик.
+	withCert := func(cn string) (context.Context, error) {
+		ctx := context.Background()
+		if cn != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+				State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			}})
+		}
+		var handlerCtx context.Context
+		_, err := o.agentAuthUnary(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			handlerCtx = ctx
+			return nil, nil
+		})
+		return handlerCtx, err
+	}
+
+	if _, err := withCert(""); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("без сертификата и токена ожидался Unauthenticated, имеем: %v", err)
+	}
+	agent1, err := withCert("agent-1")
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+	agent2, err := withCert("agent-2")
+	if err != nil {
+		t.Fatalf("неожиданная ошибка: %v", err)
+	}
+
+	scheduleExpression(t, o, userID, "1+1", nil)
+	batch, err := s.GetTasks(agent1, &proto.TaskRequest{ComputingPower: 1})
+	if err != nil || len(batch.Tasks) != 1 {
+		t.Fatalf("ожидалась одна задача, имеем: %+v, %v", batch, err)
+	}
+	task := batch.Tasks[0]
+
+	if _, err := s.SubmitResult(agent2, &proto.ResultRequest{Id: task.Id, Result: 2}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("результат чужой задачи должен отклоняться, имеем: %v", err)
+	}
+	if _, err := s.SubmitResult(agent1, &proto.ResultRequest{Id: task.Id, Result: 2}); err != nil {
+		t.Errorf("SubmitResult не удалось: %v", err)
+	}
+}
+
+func TestInternalTaskAuth(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+	o.Config.AgentTokens = parseAgentTokens("agent-1:secret1,agent-2:secret2")
+	handler := o.agentMiddleware(o.internalTaskHandler)
+
+	userToken, err := auth.GenerateJWT(userID)
+	if err != nil {
+		t.Fatalf("GenerateJWT не удалось: %v", err)
+	}
+
+	scheduleExpression(t, o, userID, "1+1", nil)
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		want   int
+	}{
+		{"Без токена", http.MethodGet, "/api/v1/internal/task", "", http.StatusUnauthorized},
+		{"Токен пользователя", http.MethodGet, "/api/v1/internal/task", userToken, http.StatusForbidden},
+		{"Токен пользователя при отправке результата", http.MethodPost, "/api/v1/internal/task", userToken, http.StatusForbidden},
+		{"Чужой agent_id", http.MethodGet, "/api/v1/internal/task?agent_id=agent-2", "secret1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.method, tt.target, tt.token, `{"id":"1","result":2}`); rec.Code != tt.want {
+				t.Errorf("ожидался статус %d, имеем %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	rec := do(http.MethodGet, "/api/v1/internal/task", "secret1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("агент должен получить задачу, имеем %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Task map[string]interface{} `json:"task"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("не удалось разобрать ответ: %v", err)
+	}
+	if len(resp.Task) != 5 || resp.Task["operation"] != "+" || resp.Task["operation_time"] == nil {
+		t.Errorf("задача должна содержать только id, arg1, arg2, operation и operation_time, имеем: %v", resp.Task)
+	}
+	taskID, _ := resp.Task["id"].(string)
+
+	body := `{"id":"` + taskID + `","result":2}`
+	if rec := do(http.MethodPost, "/api/v1/internal/task", "secret2", body); rec.Code != http.StatusForbidden {
+		t.Errorf("результат чужой задачи должен отклоняться, имеем %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/v1/internal/task", "secret1", body); rec.Code != http.StatusOK {
+		t.Errorf("результат должен приниматься, имеем %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/v1/internal/task", "secret1", body); rec.Code != http.StatusNotFound {
+		t.Errorf("повторный результат должен отклоняться с 404, имеем %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPostTaskErrors(t *testing.T) {
+	o, userID := setupTestOrchestrator(t)
+
+	_, dead := scheduleExpression(t, o, userID, "1/0", nil)
+	if err := o.submitResult("", dead[0].ID, 0, agent.CodeDivisionByZero, "division by zero"); err != nil {
+		t.Fatalf("submitResult не удалось: %v", err)
+	}
+	cancelled, tasks := scheduleExpression(t, o, userID, "1+1", nil)
+	exprID, _ := strconv.Atoi(cancelled.ID)
+	if err := o.Storage.CancelExpression(exprID, userID); err != nil {
+		t.Fatalf("CancelExpression не удалось: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		id   string
+		want int
+	}{
+		{"Неизвестная задача", context.Background(), "999", http.StatusNotFound},
+		{"Задача в dead letter", context.Background(), dead[0].ID, http.StatusConflict},
+		{"Отменённая задача", context.Background(), tasks[0].ID, http.StatusConflict},
+		{"Отменённая задача агента", context.WithValue(context.Background(), agentIDKey{}, "agent-1"), tasks[0].ID, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"id":"` + tt.id + `","result":2}`
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/internal/task", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			o.postTaskHandler(rec, req.WithContext(tt.ctx))
+			if rec.Code != tt.want {
+				t.Errorf("ожидался статус %d, имеем %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   codes.Code
+		reason string
+	}{
+		{"Не найдено", storage.ErrNotFound, codes.NotFound, "NOT_FOUND"},
+		{"Чужая аренда", storage.ErrNotLeased, codes.PermissionDenied, "TASK_NOT_LEASED"},
+		{"Отменённая задача", fmt.Errorf("complete: %w", storage.ErrTaskCancelled), codes.FailedPrecondition, "TASK_CANCELLED"},
+		{"Задача в dead letter", storage.ErrDeadLettered, codes.FailedPrecondition, "TASK_DEAD_LETTERED"},
+		{"База занята", fmt.Errorf("claim: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), codes.Unavailable, "STORAGE_BUSY"},
+		{"Готовый статус", status.Error(codes.InvalidArgument, "bad"), codes.InvalidArgument, ""},
+		{"Неизвестная ошибка", errors.New("boom"), codes.Internal, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(statusError(tt.err))
+			if st.Code() != tt.code {
+				t.Fatalf("ожидался код %v, имеем %v", tt.code, st.Code())
+			}
+			var reason string
+			for _, d := range st.Details() {
+				if info, ok := d.(*errdetails.ErrorInfo); ok {
+					reason = info.Reason
+				}
+			}
+			if reason != tt.reason {
+				t.Errorf("ожидалась причина %q, имеем %q", tt.reason, reason)
+			}
+		})
+	}
+
+	o, _ := setupTestOrchestrator(t)
+	s := &server{o: o}
+	if _, err := s.GetTask(context.Background(), &proto.TaskRequest{AgentId: "agent-1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("пустая очередь должна давать NotFound, имеем: %v", err)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"Не найдено", storage.ErrNotFound, http.StatusNotFound},
+		{"Чужая аренда", storage.ErrNotLeased, http.StatusForbidden},
+		{"Отменённая задача", storage.ErrTaskCancelled, http.StatusConflict},
+		{"База занята", fmt.Errorf("claim: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), http.StatusServiceUnavailable},
+		{"Неизвестная ошибка", errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := httpStatus(tt.err); got != tt.want {
+				t.Errorf("ожидался статус %d, имеем %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	o, _ := setupTestOrchestrator(t)
+	calculator := "/" + proto.Calculator_ServiceDesc.ServiceName + "/GetTasks"
+
+	panicking := func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	}
+	if _, err := recoverUnary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: calculator}, panicking); status.Code(err) != codes.Internal {
+		t.Errorf("паника должна превращаться в Internal, имеем: %v", err)
+	}
+
+	observe := calculatorUnary(o.observeUnary)
+	failing := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Unavailable, "busy")
+	}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	observe(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: calculator}, ok)
+	observe(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: calculator}, failing)
+	observe(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}, ok)
+
+	stats := o.grpcMetrics.snapshot()
+	if len(stats) != 1 || stats[calculator].Calls != 2 || stats[calculator].Errors != 1 {
+		t.Errorf("в метрики должны попадать только вызовы Calculator, имеем: %+v", stats)
+	}
+
+	hs := health.NewServer()
+	check := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := hs.Check(context.Background(), &healthpb.HealthCheckRequest{Service: proto.Calculator_ServiceDesc.ServiceName})
+		if err != nil {
+			t.Fatalf("Check не удалось: %v", err)
+		}
+		return resp.Status
+	}
+
+	o.updateHealth(hs)
+	if st := check(); st != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("ожидался SERVING, имеем %v", st)
+	}
+	o.Storage.GetDB().Close()
+	o.updateHealth(hs)
+	if st := check(); st != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("без базы ожидался NOT_SERVING, имеем %v", st)
+	}
+}
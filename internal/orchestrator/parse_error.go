@@ -0,0 +1,67 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const endOfInput = "конец выражения"
+
+// ParseError описывает место в исходной строке, где разбор выражения
+// остановился. Offset считается в байтах, Line и Column — в символах с единицы.
+type ParseError struct {
+	Message  string   `json:"message"`
+	Offset   int      `json:"offset"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Token    string   `json:"token"`
+	Expected []string `json:"expected,omitempty"`
+	Snippet  string   `json:"snippet"`
+}
+
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s (строка %d, позиция %d)", e.Message, e.Line, e.Column)
+	}
+	return fmt.Sprintf("%s %q (строка %d, позиция %d)", e.Message, e.Token, e.Line, e.Column)
+}
+
+func newParseError(input string, offset int, token, message string, expected ...string) *ParseError {
+	if offset > len(input) {
+		offset = len(input)
+	}
+
+	lineStart := strings.LastIndexByte(input[:offset], '\n') + 1
+	lineEnd := strings.IndexByte(input[offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(input)
+	} else {
+		lineEnd += offset
+	}
+	line := input[lineStart:lineEnd]
+	column := utf8.RuneCountInString(input[lineStart:offset]) + 1
+
+	var caret strings.Builder
+	for _, r := range input[lineStart:offset] {
+		if r == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	caret.WriteRune('^')
+	if n := utf8.RuneCountInString(token); n > 1 {
+		caret.WriteString(strings.Repeat("~", n-1))
+	}
+
+	return &ParseError{
+		Message:  message,
+		Offset:   offset,
+		Line:     strings.Count(input[:offset], "\n") + 1,
+		Column:   column,
+		Token:    token,
+		Expected: expected,
+		Snippet:  line + "\n" + caret.String(),
+	}
+}
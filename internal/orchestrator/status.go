@@ -0,0 +1,86 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"calc_service/internal/storage"
+)
+
+// errorDomain — домен причин ошибок в errdetails.ErrorInfo.
+const errorDomain = "calc_service"
+
+// busyRetryDelay — через сколько агенту стоит повторить вызов, если база занята.
+const busyRetryDelay = time.Second
+
+// statusError переводит ошибки хранилища в коды gRPC, чтобы агент мог отличить
+// пустую очередь от временного сбоя и от ошибки, которую повтор не исправит.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+
+	var st *status.Status
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		st = withReason(codes.NotFound, err, "NOT_FOUND")
+	case errors.Is(err, storage.ErrNotLeased):
+		st = withReason(codes.PermissionDenied, err, "TASK_NOT_LEASED")
+	case errors.Is(err, storage.ErrTaskCancelled):
+		st = withReason(codes.FailedPrecondition, err, "TASK_CANCELLED")
+	case errors.Is(err, storage.ErrDeadLettered):
+		st = withReason(codes.FailedPrecondition, err, "TASK_DEAD_LETTERED")
+	case errors.Is(err, storage.ErrNotPending):
+		st = withReason(codes.FailedPrecondition, err, "EXPRESSION_NOT_PENDING")
+	case errors.Is(err, storage.ErrAlreadyExists):
+		st = withReason(codes.AlreadyExists, err, "ALREADY_EXISTS")
+	case storage.IsBusy(err):
+		st = withReason(codes.Unavailable, err, "STORAGE_BUSY")
+		if d, derr := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(busyRetryDelay)}); derr == nil {
+			st = d
+		}
+	default:
+		log.Printf("Внутренняя ошибка: %v", err)
+		st = status.New(codes.Internal, "internal error")
+	}
+	return st.Err()
+}
+
+func withReason(code codes.Code, err error, reason string) *status.Status {
+	st := status.New(code, err.Error())
+	if d, derr := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain}); derr == nil {
+		return d
+	}
+	return st
+}
+
+// httpStatus — HTTP-код для ошибки хранилища, соответствующий коду statusError,
+// чтобы агенты получали одинаковые ошибки через оба транспорта.
+func httpStatus(err error) int {
+	switch status.Code(statusError(err)) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
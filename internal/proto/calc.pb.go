@@ -24,8 +24,12 @@ const (
 type TaskRequest struct {
 	state          protoimpl.MessageState `protogen:"open.v1"`
 	ComputingPower int32                  `protobuf:"varint,1,opt,name=computing_power,json=computingPower,proto3" json:"computing_power,omitempty"`
-	unknownFields  protoimpl.UnknownFields
-	sizeCache      protoimpl.SizeCache
+	AgentId        string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	// Операции, которые умеет выполнять агент. Используются, если агент
+	// не зарегистрирован; пустой список — без ограничений.
+	Operations    []string `protobuf:"bytes,3,rep,name=operations,proto3" json:"operations,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *TaskRequest) Reset() {
@@ -65,6 +69,20 @@ func (x *TaskRequest) GetComputingPower() int32 {
 	return 0
 }
 
+func (x *TaskRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *TaskRequest) GetOperations() []string {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
 type TaskResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
@@ -141,17 +159,63 @@ func (x *TaskResponse) GetOperationTime() int32 {
 	return 0
 }
 
+type TaskBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tasks         []*TaskResponse        `protobuf:"bytes,1,rep,name=tasks,proto3" json:"tasks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TaskBatch) Reset() {
+	*x = TaskBatch{}
+	mi := &file_internal_proto_calc_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TaskBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TaskBatch) ProtoMessage() {}
+
+func (x *TaskBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TaskBatch.ProtoReflect.Descriptor instead.
+func (*TaskBatch) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TaskBatch) GetTasks() []*TaskResponse {
+	if x != nil {
+		return x.Tasks
+	}
+	return nil
+}
+
 type ResultRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 	Result        float64                `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	ErrorCode     string                 `protobuf:"bytes,3,opt,name=error_code,json=errorCode,proto3" json:"error_code,omitempty"`
+	ErrorMessage  string                 `protobuf:"bytes,4,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *ResultRequest) Reset() {
 	*x = ResultRequest{}
-	mi := &file_internal_proto_calc_proto_msgTypes[2]
+	mi := &file_internal_proto_calc_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -163,7 +227,7 @@ func (x *ResultRequest) String() string {
 func (*ResultRequest) ProtoMessage() {}
 
 func (x *ResultRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_calc_proto_msgTypes[2]
+	mi := &file_internal_proto_calc_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -176,7 +240,7 @@ func (x *ResultRequest) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ResultRequest.ProtoReflect.Descriptor instead.
 func (*ResultRequest) Descriptor() ([]byte, []int) {
-	return file_internal_proto_calc_proto_rawDescGZIP(), []int{2}
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *ResultRequest) GetId() string {
@@ -193,6 +257,20 @@ func (x *ResultRequest) GetResult() float64 {
 	return 0
 }
 
+func (x *ResultRequest) GetErrorCode() string {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return ""
+}
+
+func (x *ResultRequest) GetErrorMessage() string {
+	if x != nil {
+		return x.ErrorMessage
+	}
+	return ""
+}
+
 type ResultResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
@@ -202,7 +280,7 @@ type ResultResponse struct {
 
 func (x *ResultResponse) Reset() {
 	*x = ResultResponse{}
-	mi := &file_internal_proto_calc_proto_msgTypes[3]
+	mi := &file_internal_proto_calc_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -214,7 +292,7 @@ func (x *ResultResponse) String() string {
 func (*ResultResponse) ProtoMessage() {}
 
 func (x *ResultResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_calc_proto_msgTypes[3]
+	mi := &file_internal_proto_calc_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -227,7 +305,7 @@ func (x *ResultResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ResultResponse.ProtoReflect.Descriptor instead.
 func (*ResultResponse) Descriptor() ([]byte, []int) {
-	return file_internal_proto_calc_proto_rawDescGZIP(), []int{3}
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *ResultResponse) GetSuccess() bool {
@@ -237,28 +315,346 @@ func (x *ResultResponse) GetSuccess() bool {
 	return false
 }
 
+type ResultBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Results       []*ResultRequest       `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ResultBatch) Reset() {
+	*x = ResultBatch{}
+	mi := &file_internal_proto_calc_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ResultBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResultBatch) ProtoMessage() {}
+
+func (x *ResultBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResultBatch.ProtoReflect.Descriptor instead.
+func (*ResultBatch) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ResultBatch) GetResults() []*ResultRequest {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+type ResultBatchResponse struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Accepted int32                  `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	// Результаты, которые оркестратор отклонил окончательно: повтор не поможет.
+	FailedIds []string `protobuf:"bytes,2,rep,name=failed_ids,json=failedIds,proto3" json:"failed_ids,omitempty"`
+	// Результаты, не принятые из-за временного сбоя; агент должен отправить их снова.
+	RetryIds      []string `protobuf:"bytes,3,rep,name=retry_ids,json=retryIds,proto3" json:"retry_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ResultBatchResponse) Reset() {
+	*x = ResultBatchResponse{}
+	mi := &file_internal_proto_calc_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ResultBatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResultBatchResponse) ProtoMessage() {}
+
+func (x *ResultBatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResultBatchResponse.ProtoReflect.Descriptor instead.
+func (*ResultBatchResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ResultBatchResponse) GetAccepted() int32 {
+	if x != nil {
+		return x.Accepted
+	}
+	return 0
+}
+
+func (x *ResultBatchResponse) GetFailedIds() []string {
+	if x != nil {
+		return x.FailedIds
+	}
+	return nil
+}
+
+func (x *ResultBatchResponse) GetRetryIds() []string {
+	if x != nil {
+		return x.RetryIds
+	}
+	return nil
+}
+
+type AgentInfo struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	AgentId    string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Hostname   string                 `protobuf:"bytes,2,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Version    string                 `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
+	Workers    int32                  `protobuf:"varint,4,opt,name=workers,proto3" json:"workers,omitempty"`
+	Operations []string               `protobuf:"bytes,5,rep,name=operations,proto3" json:"operations,omitempty"`
+	// Необязательные веса операций: при прочих равных агент получает задачи
+	// с операциями большего веса.
+	Weights       map[string]int32 `protobuf:"bytes,6,rep,name=weights,proto3" json:"weights,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentInfo) Reset() {
+	*x = AgentInfo{}
+	mi := &file_internal_proto_calc_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentInfo) ProtoMessage() {}
+
+func (x *AgentInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentInfo.ProtoReflect.Descriptor instead.
+func (*AgentInfo) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *AgentInfo) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *AgentInfo) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *AgentInfo) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *AgentInfo) GetWorkers() int32 {
+	if x != nil {
+		return x.Workers
+	}
+	return 0
+}
+
+func (x *AgentInfo) GetOperations() []string {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+func (x *AgentInfo) GetWeights() map[string]int32 {
+	if x != nil {
+		return x.Weights
+	}
+	return nil
+}
+
+type HeartbeatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeartbeatRequest) Reset() {
+	*x = HeartbeatRequest{}
+	mi := &file_internal_proto_calc_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeartbeatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeartbeatRequest) ProtoMessage() {}
+
+func (x *HeartbeatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeartbeatRequest.ProtoReflect.Descriptor instead.
+func (*HeartbeatRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *HeartbeatRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type AgentAck struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Интервал, с которым агент должен присылать Heartbeat.
+	HeartbeatIntervalMs int32 `protobuf:"varint,1,opt,name=heartbeat_interval_ms,json=heartbeatIntervalMs,proto3" json:"heartbeat_interval_ms,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *AgentAck) Reset() {
+	*x = AgentAck{}
+	mi := &file_internal_proto_calc_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentAck) ProtoMessage() {}
+
+func (x *AgentAck) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_calc_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentAck.ProtoReflect.Descriptor instead.
+func (*AgentAck) Descriptor() ([]byte, []int) {
+	return file_internal_proto_calc_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *AgentAck) GetHeartbeatIntervalMs() int32 {
+	if x != nil {
+		return x.HeartbeatIntervalMs
+	}
+	return 0
+}
+
 var File_internal_proto_calc_proto protoreflect.FileDescriptor
 
 const file_internal_proto_calc_proto_rawDesc = "" +
 	"\n" +
-	"\x19internal/proto/calc.proto\x12\fcalc_service\"6\n" +
+	"\x19internal/proto/calc.proto\x12\fcalc_service\"q\n" +
 	"\vTaskRequest\x12'\n" +
-	"\x0fcomputing_power\x18\x01 \x01(\x05R\x0ecomputingPower\"\x8b\x01\n" +
+	"\x0fcomputing_power\x18\x01 \x01(\x05R\x0ecomputingPower\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\x12\x1e\n" +
+	"\n" +
+	"operations\x18\x03 \x03(\tR\n" +
+	"operations\"\x8b\x01\n" +
 	"\fTaskResponse\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
 	"\x04arg1\x18\x02 \x01(\x01R\x04arg1\x12\x12\n" +
 	"\x04arg2\x18\x03 \x01(\x01R\x04arg2\x12\x1c\n" +
 	"\toperation\x18\x04 \x01(\tR\toperation\x12%\n" +
-	"\x0eoperation_time\x18\x05 \x01(\x05R\roperationTime\"7\n" +
+	"\x0eoperation_time\x18\x05 \x01(\x05R\roperationTime\"=\n" +
+	"\tTaskBatch\x120\n" +
+	"\x05tasks\x18\x01 \x03(\v2\x1a.calc_service.TaskResponseR\x05tasks\"{\n" +
 	"\rResultRequest\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
-	"\x06result\x18\x02 \x01(\x01R\x06result\"*\n" +
+	"\x06result\x18\x02 \x01(\x01R\x06result\x12\x1d\n" +
+	"\n" +
+	"error_code\x18\x03 \x01(\tR\terrorCode\x12#\n" +
+	"\rerror_message\x18\x04 \x01(\tR\ferrorMessage\"*\n" +
 	"\x0eResultResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess2\x9d\x01\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"D\n" +
+	"\vResultBatch\x125\n" +
+	"\aresults\x18\x01 \x03(\v2\x1b.calc_service.ResultRequestR\aresults\"m\n" +
+	"\x13ResultBatchResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\x05R\baccepted\x12\x1d\n" +
+	"\n" +
+	"failed_ids\x18\x02 \x03(\tR\tfailedIds\x12\x1b\n" +
+	"\tretry_ids\x18\x03 \x03(\tR\bretryIds\"\x92\x02\n" +
+	"\tAgentInfo\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1a\n" +
+	"\bhostname\x18\x02 \x01(\tR\bhostname\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\tR\aversion\x12\x18\n" +
+	"\aworkers\x18\x04 \x01(\x05R\aworkers\x12\x1e\n" +
+	"\n" +
+	"operations\x18\x05 \x03(\tR\n" +
+	"operations\x12>\n" +
+	"\aweights\x18\x06 \x03(\v2$.calc_service.AgentInfo.WeightsEntryR\aweights\x1a:\n" +
+	"\fWeightsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x05R\x05value:\x028\x01\"-\n" +
+	"\x10HeartbeatRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\">\n" +
+	"\bAgentAck\x122\n" +
+	"\x15heartbeat_interval_ms\x18\x01 \x01(\x05R\x13heartbeatIntervalMs2\x85\x04\n" +
 	"\n" +
 	"Calculator\x12B\n" +
 	"\aGetTask\x12\x19.calc_service.TaskRequest\x1a\x1a.calc_service.TaskResponse\"\x00\x12K\n" +
-	"\fSubmitResult\x12\x1b.calc_service.ResultRequest\x1a\x1c.calc_service.ResultResponse\"\x00B\tZ\a./protob\x06proto3"
+	"\fSubmitResult\x12\x1b.calc_service.ResultRequest\x1a\x1c.calc_service.ResultResponse\"\x00\x12@\n" +
+	"\bGetTasks\x12\x19.calc_service.TaskRequest\x1a\x17.calc_service.TaskBatch\"\x00\x12O\n" +
+	"\rSubmitResults\x12\x19.calc_service.ResultBatch\x1a!.calc_service.ResultBatchResponse\"\x00\x12H\n" +
+	"\vStreamTasks\x12\x19.calc_service.TaskRequest\x1a\x1a.calc_service.TaskResponse\"\x000\x01\x12B\n" +
+	"\rRegisterAgent\x12\x17.calc_service.AgentInfo\x1a\x16.calc_service.AgentAck\"\x00\x12E\n" +
+	"\tHeartbeat\x12\x1e.calc_service.HeartbeatRequest\x1a\x16.calc_service.AgentAck\"\x00B\tZ\a./protob\x06proto3"
 
 var (
 	file_internal_proto_calc_proto_rawDescOnce sync.Once
@@ -272,23 +668,43 @@ func file_internal_proto_calc_proto_rawDescGZIP() []byte {
 	return file_internal_proto_calc_proto_rawDescData
 }
 
-var file_internal_proto_calc_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_internal_proto_calc_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
 var file_internal_proto_calc_proto_goTypes = []any{
-	(*TaskRequest)(nil),    // 0: calc_service.TaskRequest
-	(*TaskResponse)(nil),   // 1: calc_service.TaskResponse
-	(*ResultRequest)(nil),  // 2: calc_service.ResultRequest
-	(*ResultResponse)(nil), // 3: calc_service.ResultResponse
+	(*TaskRequest)(nil),         // 0: calc_service.TaskRequest
+	(*TaskResponse)(nil),        // 1: calc_service.TaskResponse
+	(*TaskBatch)(nil),           // 2: calc_service.TaskBatch
+	(*ResultRequest)(nil),       // 3: calc_service.ResultRequest
+	(*ResultResponse)(nil),      // 4: calc_service.ResultResponse
+	(*ResultBatch)(nil),         // 5: calc_service.ResultBatch
+	(*ResultBatchResponse)(nil), // 6: calc_service.ResultBatchResponse
+	(*AgentInfo)(nil),           // 7: calc_service.AgentInfo
+	(*HeartbeatRequest)(nil),    // 8: calc_service.HeartbeatRequest
+	(*AgentAck)(nil),            // 9: calc_service.AgentAck
+	nil,                         // 10: calc_service.AgentInfo.WeightsEntry
 }
 var file_internal_proto_calc_proto_depIdxs = []int32{
-	0, // 0: calc_service.Calculator.GetTask:input_type -> calc_service.TaskRequest
-	2, // 1: calc_service.Calculator.SubmitResult:input_type -> calc_service.ResultRequest
-	1, // 2: calc_service.Calculator.GetTask:output_type -> calc_service.TaskResponse
-	3, // 3: calc_service.Calculator.SubmitResult:output_type -> calc_service.ResultResponse
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	1,  // 0: calc_service.TaskBatch.tasks:type_name -> calc_service.TaskResponse
+	3,  // 1: calc_service.ResultBatch.results:type_name -> calc_service.ResultRequest
+	10, // 2: calc_service.AgentInfo.weights:type_name -> calc_service.AgentInfo.WeightsEntry
+	0,  // 3: calc_service.Calculator.GetTask:input_type -> calc_service.TaskRequest
+	3,  // 4: calc_service.Calculator.SubmitResult:input_type -> calc_service.ResultRequest
+	0,  // 5: calc_service.Calculator.GetTasks:input_type -> calc_service.TaskRequest
+	5,  // 6: calc_service.Calculator.SubmitResults:input_type -> calc_service.ResultBatch
+	0,  // 7: calc_service.Calculator.StreamTasks:input_type -> calc_service.TaskRequest
+	7,  // 8: calc_service.Calculator.RegisterAgent:input_type -> calc_service.AgentInfo
+	8,  // 9: calc_service.Calculator.Heartbeat:input_type -> calc_service.HeartbeatRequest
+	1,  // 10: calc_service.Calculator.GetTask:output_type -> calc_service.TaskResponse
+	4,  // 11: calc_service.Calculator.SubmitResult:output_type -> calc_service.ResultResponse
+	2,  // 12: calc_service.Calculator.GetTasks:output_type -> calc_service.TaskBatch
+	6,  // 13: calc_service.Calculator.SubmitResults:output_type -> calc_service.ResultBatchResponse
+	1,  // 14: calc_service.Calculator.StreamTasks:output_type -> calc_service.TaskResponse
+	9,  // 15: calc_service.Calculator.RegisterAgent:output_type -> calc_service.AgentAck
+	9,  // 16: calc_service.Calculator.Heartbeat:output_type -> calc_service.AgentAck
+	10, // [10:17] is the sub-list for method output_type
+	3,  // [3:10] is the sub-list for method input_type
+	3,  // [3:3] is the sub-list for extension type_name
+	3,  // [3:3] is the sub-list for extension extendee
+	0,  // [0:3] is the sub-list for field type_name
 }
 
 func init() { file_internal_proto_calc_proto_init() }
@@ -302,7 +718,7 @@ func file_internal_proto_calc_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_proto_calc_proto_rawDesc), len(file_internal_proto_calc_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   11,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
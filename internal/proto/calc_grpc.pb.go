@@ -19,8 +19,13 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	Calculator_GetTask_FullMethodName      = "/calc_service.Calculator/GetTask"
-	Calculator_SubmitResult_FullMethodName = "/calc_service.Calculator/SubmitResult"
+	Calculator_GetTask_FullMethodName       = "/calc_service.Calculator/GetTask"
+	Calculator_SubmitResult_FullMethodName  = "/calc_service.Calculator/SubmitResult"
+	Calculator_GetTasks_FullMethodName      = "/calc_service.Calculator/GetTasks"
+	Calculator_SubmitResults_FullMethodName = "/calc_service.Calculator/SubmitResults"
+	Calculator_StreamTasks_FullMethodName   = "/calc_service.Calculator/StreamTasks"
+	Calculator_RegisterAgent_FullMethodName = "/calc_service.Calculator/RegisterAgent"
+	Calculator_Heartbeat_FullMethodName     = "/calc_service.Calculator/Heartbeat"
 )
 
 // CalculatorClient is the client API for Calculator service.
@@ -29,6 +34,14 @@ const (
 type CalculatorClient interface {
 	GetTask(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*TaskResponse, error)
 	SubmitResult(ctx context.Context, in *ResultRequest, opts ...grpc.CallOption) (*ResultResponse, error)
+	// GetTasks выдаёт в аренду до computing_power готовых задач за один вызов.
+	GetTasks(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*TaskBatch, error)
+	SubmitResults(ctx context.Context, in *ResultBatch, opts ...grpc.CallOption) (*ResultBatchResponse, error)
+	// StreamTasks отправляет агенту готовые задачи по мере их появления,
+	// пока у него есть свободные воркеры (computing_power).
+	StreamTasks(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[TaskResponse], error)
+	RegisterAgent(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*AgentAck, error)
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*AgentAck, error)
 }
 
 type calculatorClient struct {
@@ -59,12 +72,79 @@ func (c *calculatorClient) SubmitResult(ctx context.Context, in *ResultRequest,
 	return out, nil
 }
 
+func (c *calculatorClient) GetTasks(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*TaskBatch, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TaskBatch)
+	err := c.cc.Invoke(ctx, Calculator_GetTasks_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculatorClient) SubmitResults(ctx context.Context, in *ResultBatch, opts ...grpc.CallOption) (*ResultBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ResultBatchResponse)
+	err := c.cc.Invoke(ctx, Calculator_SubmitResults_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculatorClient) StreamTasks(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[TaskResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Calculator_ServiceDesc.Streams[0], Calculator_StreamTasks_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[TaskRequest, TaskResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Calculator_StreamTasksClient = grpc.ServerStreamingClient[TaskResponse]
+
+func (c *calculatorClient) RegisterAgent(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*AgentAck, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AgentAck)
+	err := c.cc.Invoke(ctx, Calculator_RegisterAgent_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculatorClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*AgentAck, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AgentAck)
+	err := c.cc.Invoke(ctx, Calculator_Heartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CalculatorServer is the server API for Calculator service.
 // All implementations must embed UnimplementedCalculatorServer
 // for forward compatibility.
 type CalculatorServer interface {
 	GetTask(context.Context, *TaskRequest) (*TaskResponse, error)
 	SubmitResult(context.Context, *ResultRequest) (*ResultResponse, error)
+	// GetTasks выдаёт в аренду до computing_power готовых задач за один вызов.
+	GetTasks(context.Context, *TaskRequest) (*TaskBatch, error)
+	SubmitResults(context.Context, *ResultBatch) (*ResultBatchResponse, error)
+	// StreamTasks отправляет агенту готовые задачи по мере их появления,
+	// пока у него есть свободные воркеры (computing_power).
+	StreamTasks(*TaskRequest, grpc.ServerStreamingServer[TaskResponse]) error
+	RegisterAgent(context.Context, *AgentInfo) (*AgentAck, error)
+	Heartbeat(context.Context, *HeartbeatRequest) (*AgentAck, error)
 	mustEmbedUnimplementedCalculatorServer()
 }
 
@@ -81,6 +161,21 @@ func (UnimplementedCalculatorServer) GetTask(context.Context, *TaskRequest) (*Ta
 func (UnimplementedCalculatorServer) SubmitResult(context.Context, *ResultRequest) (*ResultResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SubmitResult not implemented")
 }
+func (UnimplementedCalculatorServer) GetTasks(context.Context, *TaskRequest) (*TaskBatch, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTasks not implemented")
+}
+func (UnimplementedCalculatorServer) SubmitResults(context.Context, *ResultBatch) (*ResultBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitResults not implemented")
+}
+func (UnimplementedCalculatorServer) StreamTasks(*TaskRequest, grpc.ServerStreamingServer[TaskResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamTasks not implemented")
+}
+func (UnimplementedCalculatorServer) RegisterAgent(context.Context, *AgentInfo) (*AgentAck, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterAgent not implemented")
+}
+func (UnimplementedCalculatorServer) Heartbeat(context.Context, *HeartbeatRequest) (*AgentAck, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
 func (UnimplementedCalculatorServer) mustEmbedUnimplementedCalculatorServer() {}
 func (UnimplementedCalculatorServer) testEmbeddedByValue()                    {}
 
@@ -138,6 +233,89 @@ func _Calculator_SubmitResult_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Calculator_GetTasks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).GetTasks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculator_GetTasks_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).GetTasks(ctx, req.(*TaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculator_SubmitResults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResultBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).SubmitResults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculator_SubmitResults_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).SubmitResults(ctx, req.(*ResultBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculator_StreamTasks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TaskRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CalculatorServer).StreamTasks(m, &grpc.GenericServerStream[TaskRequest, TaskResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Calculator_StreamTasksServer = grpc.ServerStreamingServer[TaskResponse]
+
+func _Calculator_RegisterAgent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentInfo)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).RegisterAgent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculator_RegisterAgent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).RegisterAgent(ctx, req.(*AgentInfo))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Calculator_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Calculator_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Calculator_ServiceDesc is the grpc.ServiceDesc for Calculator service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -153,7 +331,29 @@ var Calculator_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SubmitResult",
 			Handler:    _Calculator_SubmitResult_Handler,
 		},
+		{
+			MethodName: "GetTasks",
+			Handler:    _Calculator_GetTasks_Handler,
+		},
+		{
+			MethodName: "SubmitResults",
+			Handler:    _Calculator_SubmitResults_Handler,
+		},
+		{
+			MethodName: "RegisterAgent",
+			Handler:    _Calculator_RegisterAgent_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _Calculator_Heartbeat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamTasks",
+			Handler:       _Calculator_StreamTasks_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "internal/proto/calc.proto",
 }
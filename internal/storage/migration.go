@@ -1,15 +1,19 @@
 package storage
 
 import (
+	"embed"
 	"fmt"
 
 	"github.com/pressly/goose/v3"
 )
 
 const (
-	migrationsDir = "migrations"
+	migrationsDir = "migration"
 )
 
+//go:embed migration/*.sql
+var embedMigrations embed.FS
+
 func (s *Storage) Migrate() error {
 	goose.SetBaseFS(embedMigrations)
 
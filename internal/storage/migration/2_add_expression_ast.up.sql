@@ -1 +1,2 @@
+-- +goose Up
 ALTER TABLE expressions ADD COLUMN ast_json TEXT;
\ No newline at end of file
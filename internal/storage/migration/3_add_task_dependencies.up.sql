@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE tasks ADD COLUMN parent_id INTEGER REFERENCES tasks(id);
+ALTER TABLE tasks ADD COLUMN arg1_task_id INTEGER REFERENCES tasks(id);
+ALTER TABLE tasks ADD COLUMN arg2_task_id INTEGER REFERENCES tasks(id);
+
+CREATE INDEX IF NOT EXISTS idx_tasks_parent ON tasks(parent_id);
@@ -0,0 +1,2 @@
+-- +goose Up
+ALTER TABLE expressions ADD COLUMN tasks_saved INTEGER NOT NULL DEFAULT 0;
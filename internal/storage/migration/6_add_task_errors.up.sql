@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE tasks ADD COLUMN error_code TEXT;
+ALTER TABLE tasks ADD COLUMN error_message TEXT;
+ALTER TABLE tasks ADD COLUMN dead_lettered_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_dead_lettered ON tasks(dead_lettered_at);
@@ -0,0 +1,3 @@
+-- +goose Up
+ALTER TABLE expressions ADD COLUMN error_reason TEXT;
+ALTER TABLE tasks ADD COLUMN cancelled_at DATETIME;
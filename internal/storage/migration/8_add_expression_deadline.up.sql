@@ -0,0 +1,4 @@
+-- +goose Up
+ALTER TABLE expressions ADD COLUMN deadline_at INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_expressions_deadline ON expressions(status, deadline_at);
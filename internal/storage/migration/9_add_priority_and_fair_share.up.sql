@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE expressions ADD COLUMN priority INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN last_claim_seq INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_expressions_priority ON expressions(status, priority);
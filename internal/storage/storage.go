@@ -1,22 +1,37 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	"embed"
 	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 var (
 	ErrNotFound      = errors.New("not found")
 	ErrAlreadyExists = errors.New("already exists")
+	ErrNotPending    = errors.New("expression is not pending")
+	ErrTaskCancelled = errors.New("task cancelled")
+	ErrNotLeased     = errors.New("task is not leased to this agent")
+	ErrDeadLettered  = errors.New("task is dead-lettered")
 )
 
-var embedMigrations embed.FS
+// Причины, по которым выражение получает статус error.
+const (
+	ReasonDivisionByZero   = "division_by_zero"
+	ReasonDomainError      = "domain_error"
+	ReasonOverflow         = "overflow"
+	ReasonTimeout          = "timeout"
+	ReasonParseError       = "parse_error"
+	ReasonUnboundVariables = "unbound_variables"
+	ReasonInternalError    = "internal_error"
+)
 
 type User struct {
 	ID       int
@@ -25,34 +40,91 @@ type User struct {
 }
 
 type Expression struct {
-	ID         int
-	UserID     int
-	Expression string
-	Status     string
-	Result     *float64
-	CreatedAt  time.Time
+	ID          int
+	UserID      int
+	Expression  string
+	Status      string
+	Result      *float64
+	ErrorReason string
+	TasksSaved  int
+	Priority    int
+	Deadline    *time.Time
+	CreatedAt   time.Time
 }
 
 type Task struct {
 	ID            string
 	ExprID        int
+	ParentID      sql.NullString
+	Arg1TaskID    sql.NullString
+	Arg2TaskID    sql.NullString
 	Arg1          float64
 	Arg2          float64
 	Operation     string
 	OperationTime int
 	StartedAt     sql.NullTime
+	LeaseOwner    sql.NullString
+	LeaseExpires  sql.NullInt64 // unix-время в миллисекундах
+	Attempts      int
+	ErrorCode     sql.NullString
+	ErrorMessage  sql.NullString
+	DeadLettered  sql.NullTime
+	Cancelled     sql.NullTime
 	Completed     bool
 	Result        sql.NullFloat64
+
+	// Left и Right указывают на задачи, чьи результаты станут Arg1 и Arg2.
+	// Используются только в CreateTasks, пока ID зависимостей ещё неизвестны.
+	Left, Right *Task
 }
 
+const (
+	DefaultLeaseSlack   = 5 * time.Second
+	DefaultMaxAttempts  = 3
+	DefaultRetryBackoff = time.Second
+)
+
+// CodeLeaseExpired — код ошибки задачи, аренда которой истекла MaxAttempts раз подряд:
+// агенты падают или зависают на ней, поэтому она больше не выдаётся.
+const CodeLeaseExpired = "lease_expired"
+
 type Storage struct {
 	db *sql.DB
+
+	// LeaseSlack добавляется к operation_time задачи при выдаче аренды:
+	// если агент не вернул результат до истечения аренды, задача снова попадает в очередь.
+	LeaseSlack time.Duration
+
+	// MaxAttempts ограничивает число повторов задачи после временной ошибки,
+	// RetryBackoff — задержка перед первым повтором, дальше она удваивается.
+	MaxAttempts  int
+	RetryBackoff time.Duration
 }
 
 func (s *Storage) GetDB() *sql.DB {
 	return s.db
 }
 
+// Ready проверяет, что база доступна и схема обновлена: запрос читает столбцы,
+// добавленные последними миграциями каждой таблицы.
+func (s *Storage) Ready(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping db: %w", err)
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT u.last_claim_seq, e.priority, e.deadline_at, e.error_reason, 
+                t.lease_owner, t.dead_lettered_at, t.cancelled_at
+         FROM tasks t
+         JOIN expressions e ON e.id = t.expression_id
+         JOIN users u ON u.id = e.user_id
+         LIMIT 0`,
+	)
+	if err != nil {
+		return fmt.Errorf("schema is not up to date: %w", err)
+	}
+	return rows.Close()
+}
+
 func (s *Storage) CreateUser(login, password string) (int, error) {
 	var id int
 	err := s.db.QueryRow(
@@ -134,12 +206,14 @@ func (s *Storage) CreateExpression(userID int, expr string) (*Expression, error)
 func (s *Storage) GetExpressionByID(id, userID int) (*Expression, error) {
 	e := &Expression{ID: id, UserID: userID}
 	var result sql.NullFloat64
+	var reason sql.NullString
+	var deadline sql.NullInt64
 	err := s.db.QueryRow(
-		`SELECT expression, status, result, created_at 
+		`SELECT expression, status, result, error_reason, tasks_saved, priority, deadline_at, created_at 
 		FROM expressions 
 		WHERE id = ? AND user_id = ?`,
 		id, userID,
-	).Scan(&e.Expression, &e.Status, &result, &e.CreatedAt)
+	).Scan(&e.Expression, &e.Status, &result, &reason, &e.TasksSaved, &e.Priority, &deadline, &e.CreatedAt)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -151,12 +225,17 @@ func (s *Storage) GetExpressionByID(id, userID int) (*Expression, error) {
 	if result.Valid {
 		e.Result = &result.Float64
 	}
+	e.ErrorReason = reason.String
+	if deadline.Valid {
+		d := time.UnixMilli(deadline.Int64)
+		e.Deadline = &d
+	}
 	return e, nil
 }
 
 func (s *Storage) GetExpressions(userID int) ([]*Expression, error) {
 	rows, err := s.db.Query(
-		`SELECT id, expression, status, result 
+		`SELECT id, expression, status, result, error_reason 
          FROM expressions 
          WHERE user_id = ? 
          ORDER BY created_at DESC`,
@@ -171,69 +250,399 @@ func (s *Storage) GetExpressions(userID int) ([]*Expression, error) {
 	for rows.Next() {
 		e := &Expression{}
 		var result sql.NullFloat64
-		err := rows.Scan(&e.ID, &e.Expression, &e.Status, &result)
+		var reason sql.NullString
+		err := rows.Scan(&e.ID, &e.Expression, &e.Status, &result, &reason)
 		if err != nil {
 			return nil, err
 		}
 		if result.Valid {
 			e.Result = &result.Float64
 		}
+		e.ErrorReason = reason.String
 		exprs = append(exprs, e)
 	}
 	return exprs, nil
 }
 
 func (s *Storage) UpdateExpression(e *Expression) error {
-	var result interface{}
+	var result, reason interface{}
 	if e.Result != nil {
 		result = *e.Result
 	}
+	if e.ErrorReason != "" {
+		reason = e.ErrorReason
+	}
 
 	_, err := s.db.Exec(
 		`UPDATE expressions 
-		SET status = ?, result = ? 
+		SET status = ?, result = ?, error_reason = ? 
 		WHERE id = ? AND user_id = ?`,
-		e.Status, result, e.ID, e.UserID,
+		e.Status, result, reason, e.ID, e.UserID,
 	)
 	return err
 }
 
-func (s *Storage) DeleteExpression(id, userID int) error {
+func (s *Storage) UpdateExpressionTasksSaved(id, saved int) error {
+	_, err := s.db.Exec(
+		`UPDATE expressions SET tasks_saved = ? WHERE id = ?`,
+		saved, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update expression tasks saved: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) UpdateExpressionPriority(id, priority int) error {
+	_, err := s.db.Exec(
+		"UPDATE expressions SET priority = ? WHERE id = ?",
+		priority, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update expression priority: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) UpdateExpressionDeadline(id int, deadline time.Time) error {
+	_, err := s.db.Exec(
+		"UPDATE expressions SET deadline_at = ? WHERE id = ?",
+		deadline.UnixMilli(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("update expression deadline: %w", err)
+	}
+	return nil
+}
+
+// ExpireExpressions переводит в статус timed_out выражения, не успевшие
+// вычислиться до дедлайна, и отменяет их задачи. Возвращает ID таких выражений.
+func (s *Storage) ExpireExpressions(now time.Time) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`UPDATE expressions 
+         SET status = 'timed_out', error_reason = ?
+         WHERE status = 'pending' AND deadline_at IS NOT NULL AND deadline_at <= ?
+         RETURNING id`,
+		ReasonTimeout, now.UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("expire expressions: %w", err)
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan expired expression: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("expire expressions: %w", err)
+	}
+
+	for _, id := range ids {
+		if err := cancelTasks(tx, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+func (s *Storage) UpdateExpressionAST(id int, astJSON string) error {
 	_, err := s.db.Exec(
+		`UPDATE expressions SET ast_json = ? WHERE id = ?`,
+		astJSON, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update expression ast: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) GetExpressionAST(id, userID int) (string, error) {
+	var astJSON sql.NullString
+	err := s.db.QueryRow(
+		`SELECT ast_json FROM expressions WHERE id = ? AND user_id = ?`,
+		id, userID,
+	).Scan(&astJSON)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("get expression ast: %w", err)
+	}
+	if !astJSON.Valid {
+		return "", ErrNotFound
+	}
+	return astJSON.String, nil
+}
+
+// CancelExpression останавливает вычисление выражения: невыполненные задачи
+// снимаются с очереди, а результаты, которые агенты пришлют позже, отбрасываются.
+func (s *Storage) CancelExpression(id, userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(
+		"SELECT status FROM expressions WHERE id = ? AND user_id = ?",
+		id, userID,
+	).Scan(&status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("get expression: %w", err)
+	}
+	if status != "pending" {
+		return ErrNotPending
+	}
+
+	_, err = tx.Exec(
+		"UPDATE expressions SET status = 'cancelled' WHERE id = ?",
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("cancel expression: %w", err)
+	}
+	if err := cancelTasks(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteExpression удаляет выражение вместе с его задачами.
+func (s *Storage) DeleteExpression(id, userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`DELETE FROM tasks WHERE expression_id = (
+             SELECT id FROM expressions WHERE id = ? AND user_id = ?
+         )`,
+		id, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("delete tasks: %w", err)
+	}
+
+	res, err := tx.Exec(
 		"DELETE FROM expressions WHERE id = ? AND user_id = ?",
 		id, userID,
 	)
 	if err != nil {
 		return fmt.Errorf("delete expression: %w", err)
 	}
-	return nil
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
 }
 
 func (s *Storage) CreateTask(t *Task) error {
-	_, err := s.db.Exec(
-		`INSERT INTO tasks 
-        (id, expression_id, arg1, arg2, operation, operation_time) 
-        VALUES (?, ?, ?, ?, ?, ?)`,
-		t.ID, t.ExprID, t.Arg1, t.Arg2, t.Operation, t.OperationTime,
-	)
-	return err
+	return s.CreateTasks([]*Task{t})
 }
 
-func (s *Storage) GetPendingTask() (*Task, error) {
+// CreateTasks сохраняет граф задач одного выражения в одной транзакции.
+// Зависимости должны идти в срезе раньше задач, которые их используют.
+func (s *Storage) CreateTasks(tasks []*Task) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range tasks {
+		if t.Left != nil {
+			t.Arg1TaskID = sql.NullString{String: t.Left.ID, Valid: true}
+		}
+		if t.Right != nil {
+			t.Arg2TaskID = sql.NullString{String: t.Right.ID, Valid: true}
+		}
+
+		err := tx.QueryRow(
+			`INSERT INTO tasks 
+			(expression_id, arg1, arg2, arg1_task_id, arg2_task_id, operation, operation_time) 
+			VALUES (?, ?, ?, ?, ?, ?, ?) 
+			RETURNING id`,
+			t.ExprID, t.Arg1, t.Arg2, t.Arg1TaskID, t.Arg2TaskID, t.Operation, t.OperationTime,
+		).Scan(&t.ID)
+		if err != nil {
+			return fmt.Errorf("create task: %w", err)
+		}
+
+		for _, dep := range []*Task{t.Left, t.Right} {
+			if dep == nil {
+				continue
+			}
+			dep.ParentID = sql.NullString{String: t.ID, Valid: true}
+			if _, err := tx.Exec(
+				`UPDATE tasks SET parent_id = ? WHERE id = ?`,
+				t.ID, dep.ID,
+			); err != nil {
+				return fmt.Errorf("link task: %w", err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetPendingTask выдаёт owner в аренду готовую задачу: все её зависимости
+// вычислены, а предыдущая аренда, если была, истекла. Сначала выбираются
+// выражения с большим приоритетом, внутри приоритета пользователи обслуживаются
+// по очереди: задача достаётся тому, чью задачу выдавали раньше всех.
+func (s *Storage) GetPendingTask(owner string) (*Task, error) {
+	tasks, err := s.GetPendingTasks(owner, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, ErrNotFound
+	}
+	return tasks[0], nil
+}
+
+// Capabilities — операции, которые умеет выполнять агент, с весами: при прочих
+// равных агент получает задачи с операциями большего веса. nil означает любые операции.
+type Capabilities map[string]int
+
+// GetPendingTasks выдаёт owner в аренду до limit готовых задач одной транзакцией
+// по тем же правилам, что и GetPendingTask, но только с операциями из caps.
+// Пустой список означает, что подходящих задач нет.
+func (s *Storage) GetPendingTasks(owner string, limit int, caps Capabilities) ([]*Task, error) {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
+	if err := s.deadLetterExhausted(tx); err != nil {
+		return nil, err
+	}
+
+	var tasks []*Task
+	for len(tasks) < limit {
+		t, err := s.claimTask(tx, owner, caps)
+		if errors.Is(err, ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, tx.Commit()
+}
+
+// deadLetterExhausted переносит в dead letter задачи, аренда которых истекла
+// после последней разрешённой попытки, и завершает их выражения с ошибкой.
+func (s *Storage) deadLetterExhausted(tx *sql.Tx) error {
+	rows, err := tx.Query(
+		`UPDATE tasks 
+         SET error_code = ?, error_message = ?, lease_owner = NULL, lease_expires_at = NULL, 
+             dead_lettered_at = datetime('now')
+         WHERE completed = FALSE AND dead_lettered_at IS NULL AND cancelled_at IS NULL
+           AND attempts >= ? AND lease_expires_at <= ?
+         RETURNING expression_id`,
+		CodeLeaseExpired, fmt.Sprintf("lease expired after %d attempts", s.MaxAttempts),
+		s.MaxAttempts, time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("dead-letter exhausted tasks: %w", err)
+	}
+	var exprIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan exhausted task: %w", err)
+		}
+		exprIDs = append(exprIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("dead-letter exhausted tasks: %w", err)
+	}
+
+	for _, id := range exprIDs {
+		if err := failExpression(tx, id, ReasonInternalError); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) claimTask(tx *sql.Tx, owner string, caps Capabilities) (*Task, error) {
+	now := time.Now().UnixMilli()
+	args := []interface{}{owner, now, s.LeaseSlack.Milliseconds(), now, s.MaxAttempts, now}
+
+	filter, order := "", ""
+	if caps != nil {
+		ops := make([]string, 0, len(caps))
+		for op := range caps {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+
+		filter = "AND t.operation IN (NULL" + strings.Repeat(", ?", len(ops)) + ")"
+		order = "CASE t.operation" + strings.Repeat(" WHEN ? THEN ?", len(ops)) + " ELSE 0 END DESC,"
+		for _, op := range ops {
+			args = append(args, op)
+		}
+		for _, op := range ops {
+			args = append(args, op, caps[op])
+		}
+	}
+
 	t := &Task{}
-	err = tx.QueryRow(
-		`SELECT id, expression_id, arg1, arg2, operation, operation_time 
-         FROM tasks 
-         WHERE completed = FALSE 
-         ORDER BY id ASC 
-         LIMIT 1`).Scan(
+	err := tx.QueryRow(
+		`UPDATE tasks 
+         SET started_at = datetime('now'), 
+             lease_owner = ?, 
+             lease_expires_at = ? + operation_time + ?, 
+             attempts = attempts + 1
+         WHERE id = (
+             SELECT t.id FROM tasks t
+             JOIN expressions e ON e.id = t.expression_id
+             JOIN users u ON u.id = e.user_id
+             WHERE t.completed = FALSE 
+               AND t.dead_lettered_at IS NULL
+               AND t.cancelled_at IS NULL
+               AND (t.lease_expires_at IS NULL OR t.lease_expires_at <= ?)
+               AND t.attempts < ?
+               AND NOT EXISTS (
+                   SELECT 1 FROM tasks d
+                   WHERE d.id IN (t.arg1_task_id, t.arg2_task_id) AND d.completed = FALSE
+               )
+               AND e.status = 'pending'
+               AND (e.deadline_at IS NULL OR e.deadline_at > ?)
+               `+filter+`
+             ORDER BY e.priority DESC, u.last_claim_seq ASC, `+order+` t.id ASC 
+             LIMIT 1
+         )
+         RETURNING id, expression_id, arg1, arg2, operation, operation_time, 
+             lease_owner, lease_expires_at, attempts`,
+		args...,
+	).Scan(
 		&t.ID, &t.ExprID, &t.Arg1, &t.Arg2, &t.Operation, &t.OperationTime,
+		&t.LeaseOwner, &t.LeaseExpires, &t.Attempts,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -243,27 +652,31 @@ func (s *Storage) GetPendingTask() (*Task, error) {
 	}
 
 	_, err = tx.Exec(
-		`UPDATE tasks SET started_at = datetime('now') WHERE id = ?`,
-		t.ID,
+		`UPDATE users 
+         SET last_claim_seq = (SELECT MAX(last_claim_seq) FROM users) + 1
+         WHERE id = (SELECT user_id FROM expressions WHERE id = ?)`,
+		t.ExprID,
 	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("update user claim order: %w", err)
 	}
-
-	err = tx.Commit()
-	return t, err
+	return t, nil
 }
 
 func (s *Storage) GetTaskByID(id string) (*Task, error) {
 	t := &Task{}
 	err := s.db.QueryRow(
-		`SELECT id, expression_id, arg1, arg2, operation, operation_time, 
-		started_at, completed, result 
+		`SELECT id, expression_id, parent_id, arg1_task_id, arg2_task_id, 
+		arg1, arg2, operation, operation_time, started_at, 
+		lease_owner, lease_expires_at, attempts, error_code, error_message, 
+		dead_lettered_at, cancelled_at, completed, result 
 		FROM tasks WHERE id = ?`,
 		id,
 	).Scan(
-		&t.ID, &t.ExprID, &t.Arg1, &t.Arg2, &t.Operation, &t.OperationTime,
-		&t.StartedAt, &t.Completed, &t.Result,
+		&t.ID, &t.ExprID, &t.ParentID, &t.Arg1TaskID, &t.Arg2TaskID,
+		&t.Arg1, &t.Arg2, &t.Operation, &t.OperationTime, &t.StartedAt,
+		&t.LeaseOwner, &t.LeaseExpires, &t.Attempts, &t.ErrorCode, &t.ErrorMessage,
+		&t.DeadLettered, &t.Cancelled, &t.Completed, &t.Result,
 	)
 
 	if err != nil {
@@ -277,9 +690,11 @@ func (s *Storage) GetTaskByID(id string) (*Task, error) {
 
 func (s *Storage) GetTasksByExpressionID(exprID int) ([]*Task, error) {
 	rows, err := s.db.Query(
-		`SELECT id, arg1, arg2, operation, operation_time, 
-		started_at, completed, result 
-		FROM tasks WHERE expression_id = ?`,
+		`SELECT id, parent_id, arg1_task_id, arg2_task_id, 
+		arg1, arg2, operation, operation_time, started_at, 
+		lease_owner, lease_expires_at, attempts, error_code, error_message, 
+		dead_lettered_at, cancelled_at, completed, result 
+		FROM tasks WHERE expression_id = ? ORDER BY id`,
 		exprID,
 	)
 	if err != nil {
@@ -291,8 +706,10 @@ func (s *Storage) GetTasksByExpressionID(exprID int) ([]*Task, error) {
 	for rows.Next() {
 		t := &Task{ExprID: exprID}
 		err := rows.Scan(
-			&t.ID, &t.Arg1, &t.Arg2, &t.Operation, &t.OperationTime,
-			&t.StartedAt, &t.Completed, &t.Result,
+			&t.ID, &t.ParentID, &t.Arg1TaskID, &t.Arg2TaskID,
+			&t.Arg1, &t.Arg2, &t.Operation, &t.OperationTime, &t.StartedAt,
+			&t.LeaseOwner, &t.LeaseExpires, &t.Attempts, &t.ErrorCode, &t.ErrorMessage,
+			&t.DeadLettered, &t.Cancelled, &t.Completed, &t.Result,
 		)
 		if err != nil {
 			return nil, err
@@ -302,95 +719,354 @@ func (s *Storage) GetTasksByExpressionID(exprID int) ([]*Task, error) {
 	return tasks, nil
 }
 
-func (s *Storage) CompleteTask(taskID string, result float64) error {
+// CompleteTask записывает результат задачи. Если owner задан, задача должна быть
+// арендована этим агентом, иначе возвращается ErrNotLeased.
+func (s *Storage) CompleteTask(taskID, owner string, result float64) error {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	if expired, err := expireTaskExpression(tx, taskID); err != nil || expired {
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return ErrTaskCancelled
+	}
+
 	var exprID int
+	var parentID sql.NullString
 	err = tx.QueryRow(
 		`UPDATE tasks 
          SET completed = TRUE, result = ?
-         WHERE id = ? 
-         RETURNING expression_id`,
-		result, taskID,
-	).Scan(&exprID)
+         WHERE id = ? AND completed = FALSE 
+           AND cancelled_at IS NULL AND dead_lettered_at IS NULL
+           AND (? = '' OR lease_owner = ?)
+         RETURNING expression_id, parent_id`,
+		result, taskID, owner, owner,
+	).Scan(&exprID, &parentID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return unleasedTask(tx, taskID, owner)
+		}
 		return fmt.Errorf("failed to update task: %v", err)
 	}
 
-	var pendingCount int
-	err = tx.QueryRow(
-		`SELECT COUNT(*) FROM tasks 
-         WHERE expression_id = ? AND completed = FALSE`,
-		exprID,
-	).Scan(&pendingCount)
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		reason := ReasonOverflow
+		if math.IsNaN(result) {
+			reason = ReasonDomainError
+		}
+		if err := failExpression(tx, exprID, reason); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	_, err = tx.Exec(
+		`UPDATE tasks SET arg1 = ? WHERE arg1_task_id = ?`,
+		result, taskID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to resolve dependent tasks: %v", err)
+	}
+	_, err = tx.Exec(
+		`UPDATE tasks SET arg2 = ? WHERE arg2_task_id = ?`,
+		result, taskID,
+	)
 	if err != nil {
-		return fmt.Errorf("failed to check pending tasks: %v", err)
+		return fmt.Errorf("failed to resolve dependent tasks: %v", err)
 	}
 
-	if pendingCount == 0 {
-		rows, err := tx.Query(
-			`SELECT operation, result FROM tasks 
-             WHERE expression_id = ? ORDER BY id`,
-			exprID,
+	if !parentID.Valid {
+		_, err = tx.Exec(
+			`UPDATE expressions 
+             SET status = 'completed', result = ?
+             WHERE id = ?`,
+			result, exprID,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to get task results: %v", err)
+			return fmt.Errorf("failed to update expression: %v", err)
 		}
-		defer rows.Close()
+	}
 
-		var finalResult float64
-		var hasError bool
+	return tx.Commit()
+}
 
-		for rows.Next() {
-			var op string
-			var res float64
-			if err := rows.Scan(&op, &res); err != nil {
-				hasError = true
-				break
-			}
+// failExpression переводит выражение в статус error с указанной причиной
+// и отменяет его невыполненные задачи, чтобы агенты их больше не получали.
+func failExpression(tx *sql.Tx, exprID int, reason string) error {
+	_, err := tx.Exec(
+		`UPDATE expressions 
+         SET status = 'error', error_reason = ?
+         WHERE id = ? AND status = 'pending'`,
+		reason, exprID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update expression: %w", err)
+	}
+	return cancelTasks(tx, exprID)
+}
 
-			if op == "/" && res == math.Inf(1) {
-				hasError = true
-				break
-			}
+func cancelTasks(tx *sql.Tx, exprID int) error {
+	_, err := tx.Exec(
+		`UPDATE tasks 
+         SET cancelled_at = datetime('now'), lease_owner = NULL, lease_expires_at = NULL
+         WHERE expression_id = ? AND completed = FALSE 
+           AND dead_lettered_at IS NULL AND cancelled_at IS NULL`,
+		exprID,
+	)
+	if err != nil {
+		return fmt.Errorf("cancel tasks: %w", err)
+	}
+	return nil
+}
+
+// expireTaskExpression проверяет дедлайн выражения задачи: если он прошёл, а фоновая
+// проверка ещё не успела сработать, выражение завершается по таймауту прямо здесь,
+// чтобы опоздавший результат не был учтён.
+func expireTaskExpression(tx *sql.Tx, taskID string) (bool, error) {
+	var exprID int
+	err := tx.QueryRow(
+		`UPDATE expressions 
+         SET status = 'timed_out', error_reason = ?
+         WHERE id = (SELECT expression_id FROM tasks WHERE id = ?)
+           AND status = 'pending' AND deadline_at IS NOT NULL AND deadline_at <= ?
+         RETURNING id`,
+		ReasonTimeout, taskID, time.Now().UnixMilli(),
+	).Scan(&exprID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
 		}
+		return false, fmt.Errorf("expire expression: %w", err)
+	}
+	return true, cancelTasks(tx, exprID)
+}
 
-		if hasError {
-			_, err = tx.Exec(
-				`UPDATE expressions 
-                 SET status = 'error'
-                 WHERE id = ?`,
-				exprID,
-			)
-		} else {
-			err = tx.QueryRow(
-				`SELECT SUM(result) FROM tasks 
-                 WHERE expression_id = ?`,
-				exprID,
-			).Scan(&finalResult)
-			if err != nil {
-				return fmt.Errorf("failed to calculate final result: %v", err)
-			}
+// unleasedTask уточняет missingTask: невыполненная задача, арендованная
+// не owner, даёт ErrNotLeased.
+func unleasedTask(tx *sql.Tx, taskID, owner string) error {
+	var foreign bool
+	err := tx.QueryRow(
+		`SELECT COALESCE(lease_owner, '') != ? FROM tasks 
+         WHERE id = ? AND completed = FALSE 
+           AND cancelled_at IS NULL AND dead_lettered_at IS NULL`,
+		owner, taskID,
+	).Scan(&foreign)
+	if err == nil && foreign {
+		return ErrNotLeased
+	}
+	return missingTask(tx, taskID)
+}
+
+// missingTask объясняет, почему задачу не удалось обновить: она отменена
+// вместе с выражением, попала в dead letter или её нет среди ожидающих результата.
+func missingTask(tx *sql.Tx, taskID string) error {
+	var cancelled, dead bool
+	err := tx.QueryRow(
+		"SELECT cancelled_at IS NOT NULL, dead_lettered_at IS NOT NULL FROM tasks WHERE id = ?",
+		taskID,
+	).Scan(&cancelled, &dead)
+	switch {
+	case err != nil:
+		return ErrNotFound
+	case cancelled:
+		return ErrTaskCancelled
+	case dead:
+		return ErrDeadLettered
+	}
+	return ErrNotFound
+}
+
+// TaskError — ошибка выполнения задачи, присланная агентом. Reason записывается
+// в выражение, если задача больше не будет повторяться.
+type TaskError struct {
+	Code      string
+	Message   string
+	Reason    string
+	Retryable bool
+}
+
+// FailTask записывает ошибку выполнения задачи. Задача с временной ошибкой
+// возвращается в очередь после задержки (срок аренды используется как время,
+// раньше которого задачу не выдают), пока не исчерпан MaxAttempts. Иначе она
+// попадает в dead letter, а выражение переходит в статус error. Если owner задан,
+// задача должна быть арендована этим агентом, иначе возвращается ErrNotLeased.
+func (s *Storage) FailTask(taskID, owner string, e TaskError) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if expired, err := expireTaskExpression(tx, taskID); err != nil || expired {
+		if err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+		return false, ErrTaskCancelled
+	}
 
-			_, err = tx.Exec(
-				`UPDATE expressions 
-                 SET status = 'completed', result = ?
-                 WHERE id = ?`,
-				finalResult, exprID,
-			)
+	var exprID, attempts int
+	err = tx.QueryRow(
+		`SELECT expression_id, attempts FROM tasks 
+         WHERE id = ? AND completed = FALSE 
+           AND dead_lettered_at IS NULL AND cancelled_at IS NULL
+           AND (? = '' OR lease_owner = ?)`,
+		taskID, owner, owner,
+	).Scan(&exprID, &attempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, unleasedTask(tx, taskID, owner)
 		}
+		return false, fmt.Errorf("get task: %w", err)
+	}
 
+	if e.Retryable && attempts < s.MaxAttempts {
+		backoff := s.RetryBackoff << max(attempts-1, 0)
+		_, err = tx.Exec(
+			`UPDATE tasks 
+             SET error_code = ?, error_message = ?, lease_owner = NULL, lease_expires_at = ?
+             WHERE id = ? AND (? = '' OR lease_owner = ?)`,
+			e.Code, e.Message, time.Now().Add(backoff).UnixMilli(), taskID, owner, owner,
+		)
 		if err != nil {
-			return fmt.Errorf("failed to update expression: %v", err)
+			return false, fmt.Errorf("retry task: %w", err)
 		}
+		return false, tx.Commit()
 	}
 
-	return tx.Commit()
+	_, err = tx.Exec(
+		`UPDATE tasks 
+         SET error_code = ?, error_message = ?, lease_owner = NULL, lease_expires_at = NULL, 
+             dead_lettered_at = datetime('now')
+         WHERE id = ? AND (? = '' OR lease_owner = ?)`,
+		e.Code, e.Message, taskID, owner, owner,
+	)
+	if err != nil {
+		return false, fmt.Errorf("dead-letter task: %w", err)
+	}
+
+	if err := failExpression(tx, exprID, e.Reason); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
+
+// GetDeadLetterTasks возвращает задачи, исчерпавшие попытки или завершившиеся
+// неустранимой ошибкой, начиная с самых старых.
+func (s *Storage) GetDeadLetterTasks() ([]*Task, error) {
+	rows, err := s.db.Query(
+		`SELECT id, expression_id, arg1, arg2, operation, attempts, 
+		error_code, error_message, dead_lettered_at 
+		FROM tasks WHERE dead_lettered_at IS NOT NULL 
+		ORDER BY dead_lettered_at, id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get dead-letter tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		t := &Task{}
+		err := rows.Scan(
+			&t.ID, &t.ExprID, &t.Arg1, &t.Arg2, &t.Operation, &t.Attempts,
+			&t.ErrorCode, &t.ErrorMessage, &t.DeadLettered,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("scan dead-letter task: %w", err)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// CountLeasedTasks возвращает число задач, которые owner взял в аренду
+// и ещё не вернул: по нему оркестратор считает свободные воркеры агента.
+func (s *Storage) CountLeasedTasks(owner string) (int, error) {
+	var count int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM tasks 
+         WHERE lease_owner = ? AND lease_expires_at > ? AND completed = FALSE 
+           AND dead_lettered_at IS NULL AND cancelled_at IS NULL`,
+		owner, time.Now().UnixMilli(),
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count leased tasks: %w", err)
+	}
+	return count, nil
+}
+
+// IsBusy сообщает, что запрос не дождался блокировки базы за _busy_timeout
+// и его можно повторить позже.
+func IsBusy(err error) bool {
+	var e sqlite3.Error
+	return errors.As(err, &e) && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+}
+
+// ReleaseLeases возвращает в очередь все невыполненные задачи, арендованные owner.
+// Аренда не сбрасывается, а истекает сейчас: задача, исчерпавшая MaxAttempts,
+// попадёт в dead letter при следующей выдаче задач, как и при истечении аренды.
+func (s *Storage) ReleaseLeases(owner string) (int, error) {
+	res, err := s.db.Exec(
+		`UPDATE tasks 
+         SET lease_owner = NULL, lease_expires_at = ?
+         WHERE lease_owner = ? AND completed = FALSE 
+           AND dead_lettered_at IS NULL AND cancelled_at IS NULL`,
+		time.Now().UnixMilli(), owner,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("release leases: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("release leases: %w", err)
+	}
+	return int(n), nil
+}
+
+// GetReadyOperations возвращает число готовых к выполнению и никем не арендованных задач по операциям.
+func (s *Storage) GetReadyOperations() (map[string]int, error) {
+	rows, err := s.db.Query(
+		`SELECT t.operation, COUNT(*) FROM tasks t
+         JOIN expressions e ON e.id = t.expression_id
+         WHERE t.completed = FALSE 
+           AND t.dead_lettered_at IS NULL
+           AND t.cancelled_at IS NULL
+           AND (t.lease_expires_at IS NULL OR t.lease_expires_at <= ?)
+           AND NOT EXISTS (
+               SELECT 1 FROM tasks d
+               WHERE d.id IN (t.arg1_task_id, t.arg2_task_id) AND d.completed = FALSE
+           )
+           AND e.status = 'pending'
+         GROUP BY t.operation`,
+		time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("get ready operations: %w", err)
+	}
+	defer rows.Close()
+
+	ops := make(map[string]int)
+	for rows.Next() {
+		var op string
+		var count int
+		if err := rows.Scan(&op, &count); err != nil {
+			return nil, fmt.Errorf("scan ready operation: %w", err)
+		}
+		ops[op] = count
+	}
+	return ops, rows.Err()
+}
+
 func (s *Storage) GetPendingTasksCount() (int, error) {
 	var count int
 	err := s.db.QueryRow(
@@ -418,18 +1094,28 @@ func isDuplicate(err error) bool {
 }
 
 func NewStorage(dbPath string) (*Storage, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
+	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("open db: %w", err)
 	}
 
-	storage := &Storage{db: db}
+	storage := &Storage{
+		db:           db,
+		LeaseSlack:   DefaultLeaseSlack,
+		MaxAttempts:  DefaultMaxAttempts,
+		RetryBackoff: DefaultRetryBackoff,
+	}
 	if err := storage.Init(); err != nil {
 		return nil, fmt.Errorf("init: %w", err)
 	}
+	if err := storage.Migrate(); err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
 	return storage, nil
 }
 
+// Init создаёт таблицы первой версии схемы. Всё, что добавлено позже,
+// добавляет Migrate.
 func (s *Storage) Init() error {
 	_, err := s.db.Exec(`
         CREATE TABLE IF NOT EXISTS users (
@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func setupTestDB(t *testing.T) *Storage {
@@ -89,6 +93,35 @@ func TestExpressionOperations(t *testing.T) {
 	}
 }
 
+func TestExpressionAST(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	otherID, _ := storage.CreateUser("otheruser", "hash")
+	expr, _ := storage.CreateExpression(userID, "2+2")
+
+	if _, err := storage.GetExpressionAST(expr.ID, userID); err != ErrNotFound {
+		t.Errorf("ожидалась ErrNotFound до сохранения AST, имеем: %v", err)
+	}
+
+	astJSON := `{"leaf":false,"operator":"+","task_id":"1"}`
+	if err := storage.UpdateExpressionAST(expr.ID, astJSON); err != nil {
+		t.Fatalf("UpdateExpressionAST не удалось: %v", err)
+	}
+
+	got, err := storage.GetExpressionAST(expr.ID, userID)
+	if err != nil {
+		t.Fatalf("GetExpressionAST не удалось: %v", err)
+	}
+	if got != astJSON {
+		t.Errorf("не совпадает AST, имеем: %s", got)
+	}
+
+	if _, err := storage.GetExpressionAST(expr.ID, otherID); err != ErrNotFound {
+		t.Errorf("AST не должно быть доступно другому пользователю, имеем: %v", err)
+	}
+}
+
 func TestTaskOperations(t *testing.T) {
 	storage := setupTestDB(t)
 
@@ -96,7 +129,6 @@ func TestTaskOperations(t *testing.T) {
 	expr, _ := storage.CreateExpression(userID, "2+2*2")
 
 	task := &Task{
-		ID:            "task1",
 		ExprID:        expr.ID,
 		Arg1:          2,
 		Arg2:          2,
@@ -108,21 +140,21 @@ func TestTaskOperations(t *testing.T) {
 		t.Fatalf("CreateTask не удалось: %v", err)
 	}
 
-	gotTask, err := storage.GetPendingTask()
+	gotTask, err := storage.GetPendingTask("agent-1")
 	if err != nil {
 		t.Fatalf("GetPendingTask не удалось: %v", err)
 	}
 
-	if gotTask.ID != "task1" || gotTask.Operation != "*" {
+	if gotTask.ID != task.ID || gotTask.Operation != "*" {
 		t.Errorf("не совпадают данные задачи, имеем: %+v", gotTask)
 	}
 
-	err = storage.CompleteTask("task1", 4)
+	err = storage.CompleteTask(task.ID, "agent-1", 4)
 	if err != nil {
 		t.Fatalf("CompleteTask не удалось: %v", err)
 	}
 
-	completedTask, err := storage.GetTaskByID("task1")
+	completedTask, err := storage.GetTaskByID(task.ID)
 	if err != nil {
 		t.Fatalf("GetTaskByID не удалось: %v", err)
 	}
@@ -131,3 +163,559 @@ func TestTaskOperations(t *testing.T) {
 		t.Errorf("задача(Task) выполнилась недолжным образом, имеем: %+v", completedTask)
 	}
 }
+
+func TestTaskDependencies(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "2+2*2")
+
+	mul := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 2, Operation: "*", OperationTime: 100}
+	add := &Task{ExprID: expr.ID, Arg1: 2, Operation: "+", OperationTime: 100, Right: mul}
+	if err := storage.CreateTasks([]*Task{mul, add}); err != nil {
+		t.Fatalf("CreateTasks не удалось: %v", err)
+	}
+
+	gotMul, err := storage.GetTaskByID(mul.ID)
+	if err != nil {
+		t.Fatalf("GetTaskByID не удалось: %v", err)
+	}
+	if gotMul.ParentID.String != add.ID {
+		t.Errorf("ожидался родитель %s, имеем: %+v", add.ID, gotMul.ParentID)
+	}
+
+	pending, err := storage.GetPendingTask("agent-1")
+	if err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	if pending.ID != mul.ID {
+		t.Fatalf("первой должна выдаваться задача %s, имеем: %s", mul.ID, pending.ID)
+	}
+
+	if err := storage.CompleteTask(mul.ID, "agent-1", 4); err != nil {
+		t.Fatalf("CompleteTask не удалось: %v", err)
+	}
+
+	pending, err = storage.GetPendingTask("agent-1")
+	if err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	if pending.ID != add.ID || pending.Arg1 != 2 || pending.Arg2 != 4 {
+		t.Fatalf("аргументы родительской задачи не заполнены, имеем: %+v", pending)
+	}
+
+	gotExpr, _ := storage.GetExpressionByID(expr.ID, userID)
+	if gotExpr.Status != "pending" {
+		t.Errorf("выражение не должно завершаться раньше корня, имеем: %s", gotExpr.Status)
+	}
+
+	if err := storage.CompleteTask(add.ID, "agent-1", 6); err != nil {
+		t.Fatalf("CompleteTask не удалось: %v", err)
+	}
+
+	gotExpr, _ = storage.GetExpressionByID(expr.ID, userID)
+	if gotExpr.Status != "completed" || gotExpr.Result == nil || *gotExpr.Result != 6 {
+		t.Errorf("результат выражения должен браться из корня, имеем: %+v", gotExpr)
+	}
+}
+
+func TestTaskLeases(t *testing.T) {
+	storage := setupTestDB(t)
+	storage.LeaseSlack = 0
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "2*2")
+
+	task := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 2, Operation: "*", OperationTime: 50}
+	if err := storage.CreateTask(task); err != nil {
+		t.Fatalf("CreateTask не удалось: %v", err)
+	}
+
+	first, err := storage.GetPendingTask("agent-1")
+	if err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	if first.LeaseOwner.String != "agent-1" || first.Attempts != 1 || !first.LeaseExpires.Valid {
+		t.Errorf("не заполнена аренда задачи, имеем: %+v", first)
+	}
+
+	if _, err := storage.GetPendingTask("agent-2"); err != ErrNotFound {
+		t.Fatalf("арендованная задача не должна выдаваться другому агенту, имеем: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	second, err := storage.GetPendingTask("agent-2")
+	if err != nil {
+		t.Fatalf("задача с истёкшей арендой должна вернуться в очередь: %v", err)
+	}
+	if second.ID != task.ID || second.LeaseOwner.String != "agent-2" || second.Attempts != 2 {
+		t.Errorf("аренда не перешла ко второму агенту, имеем: %+v", second)
+	}
+
+	if err := storage.CompleteTask(task.ID, "agent-1", 4); err != ErrNotLeased {
+		t.Fatalf("агент с истёкшей арендой не должен завершать задачу, имеем: %v", err)
+	}
+	if err := storage.CompleteTask(task.ID, "agent-2", 4); err != nil {
+		t.Fatalf("CompleteTask не удалось: %v", err)
+	}
+	if err := storage.CompleteTask(task.ID, "agent-2", 5); err != ErrNotFound {
+		t.Errorf("выполненная задача не должна завершаться повторно, имеем: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := storage.GetPendingTask("agent-1"); err != ErrNotFound {
+		t.Errorf("выполненная задача не должна возвращаться в очередь, имеем: %v", err)
+	}
+}
+
+func TestFailTask(t *testing.T) {
+	storage := setupTestDB(t)
+	storage.MaxAttempts = 2
+	storage.RetryBackoff = 50 * time.Millisecond
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "2/0")
+
+	task := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 0, Operation: "/", OperationTime: 100}
+	if err := storage.CreateTask(task); err != nil {
+		t.Fatalf("CreateTask не удалось: %v", err)
+	}
+
+	if _, err := storage.GetPendingTask("agent-1"); err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	dead, err := storage.FailTask(task.ID, "agent-1", TaskError{Code: "internal", Message: "connection reset", Reason: ReasonInternalError, Retryable: true})
+	if err != nil || dead {
+		t.Fatalf("временная ошибка должна вернуть задачу в очередь, имеем: %v, %v", dead, err)
+	}
+
+	if _, err := storage.GetPendingTask("agent-2"); err != ErrNotFound {
+		t.Fatalf("задача не должна выдаваться до истечения задержки, имеем: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	retried, err := storage.GetPendingTask("agent-2")
+	if err != nil {
+		t.Fatalf("задача должна быть повторена после задержки: %v", err)
+	}
+	if retried.Attempts != 2 {
+		t.Errorf("ожидалась вторая попытка, имеем: %d", retried.Attempts)
+	}
+
+	if _, err := storage.FailTask(task.ID, "agent-1", TaskError{Code: "internal", Reason: ReasonInternalError, Retryable: true}); err != ErrNotLeased {
+		t.Fatalf("агент с истёкшей арендой не должен менять чужую задачу, имеем: %v", err)
+	}
+	if got, _ := storage.GetTaskByID(task.ID); got.LeaseOwner.String != "agent-2" || got.DeadLettered.Valid {
+		t.Fatalf("аренда второго агента должна сохраниться, имеем: %+v", got)
+	}
+
+	dead, err = storage.FailTask(task.ID, "agent-2", TaskError{Code: "internal", Message: "connection reset", Reason: ReasonInternalError, Retryable: true})
+	if err != nil || !dead {
+		t.Fatalf("задача должна попасть в dead letter после исчерпания попыток, имеем: %v, %v", dead, err)
+	}
+
+	gotExpr, _ := storage.GetExpressionByID(expr.ID, userID)
+	if gotExpr.Status != "error" || gotExpr.ErrorReason != ReasonInternalError {
+		t.Errorf("ожидался статус error с причиной %s, имеем: %+v", ReasonInternalError, gotExpr)
+	}
+
+	letters, err := storage.GetDeadLetterTasks()
+	if err != nil {
+		t.Fatalf("GetDeadLetterTasks не удалось: %v", err)
+	}
+	if len(letters) != 1 || letters[0].ID != task.ID || letters[0].ErrorCode.String != "internal" {
+		t.Errorf("не совпадают dead letter задачи, имеем: %+v", letters)
+	}
+
+	if _, err := storage.FailTask(task.ID, "agent-2", TaskError{Code: "internal", Retryable: true}); err != ErrDeadLettered {
+		t.Errorf("повторная ошибка для dead letter задачи должна вернуть ErrDeadLettered, имеем: %v", err)
+	}
+}
+
+func TestCancelAndDeleteExpression(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	otherID, _ := storage.CreateUser("otheruser", "hash")
+	expr, _ := storage.CreateExpression(userID, "2+2")
+
+	task := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 2, Operation: "+", OperationTime: 100}
+	if err := storage.CreateTask(task); err != nil {
+		t.Fatalf("CreateTask не удалось: %v", err)
+	}
+	if _, err := storage.GetPendingTask("agent-1"); err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+
+	if err := storage.CancelExpression(expr.ID, otherID); err != ErrNotFound {
+		t.Errorf("чужое выражение нельзя отменить, имеем: %v", err)
+	}
+	if err := storage.CancelExpression(expr.ID, userID); err != nil {
+		t.Fatalf("CancelExpression не удалось: %v", err)
+	}
+	if err := storage.CancelExpression(expr.ID, userID); err != ErrNotPending {
+		t.Errorf("повторная отмена должна вернуть ErrNotPending, имеем: %v", err)
+	}
+
+	gotExpr, _ := storage.GetExpressionByID(expr.ID, userID)
+	if gotExpr.Status != "cancelled" {
+		t.Errorf("ожидался статус cancelled, имеем: %s", gotExpr.Status)
+	}
+	if err := storage.CompleteTask(task.ID, "agent-1", 4); err != ErrTaskCancelled {
+		t.Errorf("результат отменённой задачи должен отклоняться, имеем: %v", err)
+	}
+
+	if err := storage.DeleteExpression(expr.ID, otherID); err != ErrNotFound {
+		t.Errorf("чужое выражение нельзя удалить, имеем: %v", err)
+	}
+	if err := storage.DeleteExpression(expr.ID, userID); err != nil {
+		t.Fatalf("DeleteExpression не удалось: %v", err)
+	}
+	if _, err := storage.GetExpressionByID(expr.ID, userID); err != ErrNotFound {
+		t.Errorf("выражение должно быть удалено, имеем: %v", err)
+	}
+	if _, err := storage.GetTaskByID(task.ID); err != ErrNotFound {
+		t.Errorf("задачи выражения должны быть удалены, имеем: %v", err)
+	}
+}
+
+func TestExpireExpressions(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expired, _ := storage.CreateExpression(userID, "2+2")
+	active, _ := storage.CreateExpression(userID, "3+3")
+
+	late := &Task{ExprID: expired.ID, Arg1: 2, Arg2: 2, Operation: "+", OperationTime: 100}
+	onTime := &Task{ExprID: active.ID, Arg1: 3, Arg2: 3, Operation: "+", OperationTime: 100}
+	if err := storage.CreateTasks([]*Task{late, onTime}); err != nil {
+		t.Fatalf("CreateTasks не удалось: %v", err)
+	}
+
+	if err := storage.UpdateExpressionDeadline(expired.ID, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("UpdateExpressionDeadline не удалось: %v", err)
+	}
+	if err := storage.UpdateExpressionDeadline(active.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("UpdateExpressionDeadline не удалось: %v", err)
+	}
+
+	pending, err := storage.GetPendingTask("agent-1")
+	if err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	if pending.ID != onTime.ID {
+		t.Errorf("задачи выражения с истёкшим дедлайном не должны выдаваться, имеем: %s", pending.ID)
+	}
+
+	ids, err := storage.ExpireExpressions(time.Now())
+	if err != nil {
+		t.Fatalf("ExpireExpressions не удалось: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != expired.ID {
+		t.Errorf("ожидалось истечение выражения %d, имеем: %v", expired.ID, ids)
+	}
+
+	gotExpr, _ := storage.GetExpressionByID(expired.ID, userID)
+	if gotExpr.Status != "timed_out" || gotExpr.ErrorReason != ReasonTimeout {
+		t.Errorf("ожидался статус timed_out, имеем: %+v", gotExpr)
+	}
+	if err := storage.CompleteTask(late.ID, "agent-1", 4); err != ErrTaskCancelled {
+		t.Errorf("опоздавший результат должен отбрасываться, имеем: %v", err)
+	}
+
+	gotExpr, _ = storage.GetExpressionByID(active.ID, userID)
+	if gotExpr.Status != "pending" || gotExpr.Deadline == nil {
+		t.Errorf("выражение до дедлайна не должно истекать, имеем: %+v", gotExpr)
+	}
+}
+
+func TestCompleteTaskAfterDeadline(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "2+2")
+
+	task := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 2, Operation: "+", OperationTime: 100}
+	if err := storage.CreateTask(task); err != nil {
+		t.Fatalf("CreateTask не удалось: %v", err)
+	}
+	if _, err := storage.GetPendingTask("agent-1"); err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	storage.UpdateExpressionDeadline(expr.ID, time.Now().Add(-time.Millisecond))
+
+	if err := storage.CompleteTask(task.ID, "agent-1", 4); err != ErrTaskCancelled {
+		t.Fatalf("результат после дедлайна должен отбрасываться, имеем: %v", err)
+	}
+	gotExpr, _ := storage.GetExpressionByID(expr.ID, userID)
+	if gotExpr.Status != "timed_out" || gotExpr.Result != nil {
+		t.Errorf("выражение должно завершиться по таймауту без результата, имеем: %+v", gotExpr)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	storage := setupTestDB(t)
+
+	heavyA, _ := storage.CreateUser("heavy-a", "hash")
+	heavyB, _ := storage.CreateUser("heavy-b", "hash")
+
+	owners := make(map[string]int)
+	for _, userID := range []int{heavyA, heavyB} {
+		for i := 0; i < 5; i++ {
+			expr, _ := storage.CreateExpression(userID, "1+1")
+			task := &Task{ExprID: expr.ID, Arg1: 1, Arg2: 1, Operation: "+", OperationTime: 100}
+			if err := storage.CreateTask(task); err != nil {
+				t.Fatalf("CreateTask не удалось: %v", err)
+			}
+			owners[task.ID] = userID
+		}
+	}
+
+	var order []int
+	for i := 0; i < 10; i++ {
+		task, err := storage.GetPendingTask("agent-1")
+		if err != nil {
+			t.Fatalf("GetPendingTask не удалось: %v", err)
+		}
+		order = append(order, owners[task.ID])
+		if err := storage.CompleteTask(task.ID, "agent-1", 2); err != nil {
+			t.Fatalf("CompleteTask не удалось: %v", err)
+		}
+	}
+
+	for i := 1; i < len(order); i++ {
+		if order[i] == order[i-1] {
+			t.Fatalf("задачи пользователей должны чередоваться, имеем: %v", order)
+		}
+	}
+}
+
+func TestPriorityScheduling(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	low, _ := storage.CreateExpression(userID, "1+1")
+	high, _ := storage.CreateExpression(userID, "2+2")
+	storage.UpdateExpressionPriority(low.ID, 0)
+	storage.UpdateExpressionPriority(high.ID, 2)
+
+	lowTask := &Task{ExprID: low.ID, Arg1: 1, Arg2: 1, Operation: "+", OperationTime: 100}
+	highTask := &Task{ExprID: high.ID, Arg1: 2, Arg2: 2, Operation: "+", OperationTime: 100}
+	if err := storage.CreateTasks([]*Task{lowTask, highTask}); err != nil {
+		t.Fatalf("CreateTasks не удалось: %v", err)
+	}
+
+	task, err := storage.GetPendingTask("agent-1")
+	if err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	if task.ID != highTask.ID {
+		t.Errorf("первой должна выдаваться задача с высоким приоритетом, имеем: %s", task.ID)
+	}
+
+	gotExpr, _ := storage.GetExpressionByID(high.ID, userID)
+	if gotExpr.Priority != 2 {
+		t.Errorf("ожидался приоритет 2, имеем: %d", gotExpr.Priority)
+	}
+}
+
+func TestGetPendingTasks(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "(1+1)*(2+2)+3*3")
+
+	left := &Task{ExprID: expr.ID, Arg1: 1, Arg2: 1, Operation: "+", OperationTime: 100}
+	right := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 2, Operation: "+", OperationTime: 100}
+	mul := &Task{ExprID: expr.ID, Operation: "*", OperationTime: 100, Left: left, Right: right}
+	square := &Task{ExprID: expr.ID, Arg1: 3, Arg2: 3, Operation: "*", OperationTime: 100}
+	if err := storage.CreateTasks([]*Task{left, right, mul, square}); err != nil {
+		t.Fatalf("CreateTasks не удалось: %v", err)
+	}
+
+	tasks, err := storage.GetPendingTasks("agent-1", 2, nil)
+	if err != nil {
+		t.Fatalf("GetPendingTasks не удалось: %v", err)
+	}
+	if len(tasks) != 2 || tasks[0].ID != left.ID || tasks[1].ID != right.ID {
+		t.Fatalf("ожидались задачи %s и %s, имеем: %+v", left.ID, right.ID, tasks)
+	}
+
+	tasks, err = storage.GetPendingTasks("agent-2", 10, nil)
+	if err != nil {
+		t.Fatalf("GetPendingTasks не удалось: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].ID != square.ID {
+		t.Errorf("задачи с невычисленными зависимостями не должны выдаваться, имеем: %+v", tasks)
+	}
+
+	tasks, err = storage.GetPendingTasks("agent-2", 10, nil)
+	if err != nil || len(tasks) != 0 {
+		t.Errorf("ожидался пустой список, имеем: %+v, %v", tasks, err)
+	}
+}
+
+func TestGetPendingTasksCapabilities(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "1+1, 2*2, 3-3")
+
+	add := &Task{ExprID: expr.ID, Arg1: 1, Arg2: 1, Operation: "+", OperationTime: 100}
+	mul := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 2, Operation: "*", OperationTime: 100}
+	sub := &Task{ExprID: expr.ID, Arg1: 3, Arg2: 3, Operation: "-", OperationTime: 100}
+	if err := storage.CreateTasks([]*Task{add, mul, sub}); err != nil {
+		t.Fatalf("CreateTasks не удалось: %v", err)
+	}
+
+	tasks, err := storage.GetPendingTasks("agent-1", 10, Capabilities{"+": 0, "-": 5})
+	if err != nil {
+		t.Fatalf("GetPendingTasks не удалось: %v", err)
+	}
+	if len(tasks) != 2 || tasks[0].ID != sub.ID || tasks[1].ID != add.ID {
+		t.Fatalf("ожидались задачи %s и %s (сначала операция с большим весом), имеем: %+v", sub.ID, add.ID, tasks)
+	}
+
+	ready, err := storage.GetReadyOperations()
+	if err != nil {
+		t.Fatalf("GetReadyOperations не удалось: %v", err)
+	}
+	if len(ready) != 1 || ready["*"] != 1 {
+		t.Errorf("неподдерживаемая операция должна остаться в очереди, имеем: %v", ready)
+	}
+}
+
+func TestTaskOwnership(t *testing.T) {
+	storage := setupTestDB(t)
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "1+1")
+	task := &Task{ExprID: expr.ID, Arg1: 1, Arg2: 1, Operation: "+", OperationTime: 100}
+	if err := storage.CreateTasks([]*Task{task}); err != nil {
+		t.Fatalf("CreateTasks не удалось: %v", err)
+	}
+	fail := TaskError{Code: "internal", Reason: ReasonInternalError, Retryable: true}
+
+	if _, err := storage.FailTask(task.ID, "agent-1", fail); err != ErrNotLeased {
+		t.Errorf("ожидалась ErrNotLeased для свободной задачи, имеем: %v", err)
+	}
+	if _, err := storage.GetPendingTask("agent-1"); err != nil {
+		t.Fatalf("GetPendingTask не удалось: %v", err)
+	}
+	if _, err := storage.FailTask(task.ID, "agent-2", fail); err != ErrNotLeased {
+		t.Errorf("ожидалась ErrNotLeased для чужой задачи, имеем: %v", err)
+	}
+	if err := storage.CompleteTask(task.ID, "agent-2", 2); err != ErrNotLeased {
+		t.Errorf("ожидалась ErrNotLeased для чужой задачи, имеем: %v", err)
+	}
+	if _, err := storage.FailTask("missing", "agent-1", fail); err != ErrNotFound {
+		t.Errorf("ожидалась ErrNotFound, имеем: %v", err)
+	}
+	if err := storage.CompleteTask(task.ID, "agent-1", 2); err != nil {
+		t.Errorf("CompleteTask не удалось: %v", err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	storage := setupTestDB(t)
+
+	if err := storage.Ready(context.Background()); err != nil {
+		t.Fatalf("Ready не удалось: %v", err)
+	}
+
+	if _, err := storage.GetDB().Exec("ALTER TABLE tasks DROP COLUMN cancelled_at"); err != nil {
+		t.Fatalf("не удалось изменить схему: %v", err)
+	}
+	if err := storage.Ready(context.Background()); err == nil {
+		t.Errorf("ожидалась ошибка для устаревшей схемы")
+	}
+}
+
+func TestMigrateUpgradesOldSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+
+	// Схема первой версии сервиса, без столбцов, добавленных позже.
+	old, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("не удалось открыть базу: %v", err)
+	}
+	_, err = old.Exec(`
+        CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, login TEXT NOT NULL UNIQUE, password TEXT NOT NULL);
+        CREATE TABLE expressions (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, expression TEXT NOT NULL,
+            status TEXT NOT NULL, result REAL, created_at DATETIME DEFAULT CURRENT_TIMESTAMP);
+        CREATE TABLE tasks (id INTEGER PRIMARY KEY AUTOINCREMENT, expression_id INTEGER NOT NULL, arg1 REAL NOT NULL,
+            arg2 REAL NOT NULL, operation TEXT NOT NULL, operation_time INTEGER NOT NULL, started_at DATETIME,
+            completed BOOLEAN DEFAULT FALSE, result REAL);
+        INSERT INTO users (login, password) VALUES ('old', 'hash');
+    `)
+	old.Close()
+	if err != nil {
+		t.Fatalf("не удалось создать старую схему: %v", err)
+	}
+
+	storage, err := NewStorage(dbPath)
+	if err != nil {
+		t.Fatalf("NewStorage не удалось: %v", err)
+	}
+	defer storage.GetDB().Close()
+
+	if err := storage.Ready(context.Background()); err != nil {
+		t.Fatalf("схема должна быть обновлена: %v", err)
+	}
+	if err := storage.Migrate(); err != nil {
+		t.Fatalf("повторный Migrate не удалось: %v", err)
+	}
+
+	expr, err := storage.CreateExpression(1, "1+1")
+	if err != nil {
+		t.Fatalf("CreateExpression не удалось: %v", err)
+	}
+	task := &Task{ExprID: expr.ID, Arg1: 1, Arg2: 1, Operation: "+", OperationTime: 100}
+	if err := storage.CreateTasks([]*Task{task}); err != nil {
+		t.Fatalf("CreateTasks не удалось: %v", err)
+	}
+	if _, err := storage.GetPendingTask("agent-1"); err != nil {
+		t.Errorf("GetPendingTask не удалось: %v", err)
+	}
+}
+
+func TestLeaseExpiryExhaustsAttempts(t *testing.T) {
+	storage := setupTestDB(t)
+	storage.LeaseSlack = 0
+	storage.MaxAttempts = 2
+
+	userID, _ := storage.CreateUser("testuser", "hash")
+	expr, _ := storage.CreateExpression(userID, "2*2")
+
+	task := &Task{ExprID: expr.ID, Arg1: 2, Arg2: 2, Operation: "*", OperationTime: 20}
+	if err := storage.CreateTask(task); err != nil {
+		t.Fatalf("CreateTask не удалось: %v", err)
+	}
+
+	for i := 0; i < storage.MaxAttempts; i++ {
+		if _, err := storage.GetPendingTask("agent-1"); err != nil {
+			t.Fatalf("попытка %d: GetPendingTask не удалось: %v", i+1, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := storage.GetPendingTask("agent-2"); err != ErrNotFound {
+		t.Fatalf("задача с исчерпанными попытками не должна выдаваться, имеем: %v", err)
+	}
+
+	got, err := storage.GetTaskByID(task.ID)
+	if err != nil {
+		t.Fatalf("GetTaskByID не удалось: %v", err)
+	}
+	if !got.DeadLettered.Valid || got.ErrorCode.String != CodeLeaseExpired {
+		t.Errorf("задача должна попасть в dead letter с кодом %s, имеем: %+v", CodeLeaseExpired, got)
+	}
+
+	dbExpr, err := storage.GetExpressionByID(expr.ID, userID)
+	if err != nil {
+		t.Fatalf("GetExpressionByID не удалось: %v", err)
+	}
+	if dbExpr.Status != "error" || dbExpr.ErrorReason != ReasonInternalError {
+		t.Errorf("выражение должно завершиться ошибкой, имеем: %+v", dbExpr)
+	}
+}